@@ -0,0 +1,417 @@
+package mongonet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// notMasterCodes are the legacy "not master"/"not master or secondary"
+// error codes that indicate a command should be retried against a freshly
+// selected primary rather than surfaced to the client.
+var notMasterCodes = map[int]bool{
+	10107: true, // NotWritablePrimary
+	13435: true, // NotPrimaryNoSecondaryOk
+}
+
+// BackendConfig configures a BackendPool.
+type BackendConfig struct {
+	URI                  string // mongodb://host1:port1,host2:port2/?replicaSet=rs0
+	HeartbeatFrequencyMS int
+	MinPoolSize          int
+	MaxPoolSize          int
+}
+
+// backendConnPool is a simple min/max bounded pool of net.Conn to a single
+// mongod/mongos address.
+type backendConnPool struct {
+	address string
+	mu      sync.Mutex
+	idle    []net.Conn
+	min     int
+	max     int
+	created int
+}
+
+func newBackendConnPool(address string, min, max int) *backendConnPool {
+	return &backendConnPool{address: address, min: min, max: max}
+}
+
+func (p *backendConnPool) get() (net.Conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	if p.max > 0 && p.created >= p.max {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("backendpool: connection pool for %v exhausted (max=%v)", p.address, p.max)
+	}
+	p.created++
+	p.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", p.address, 10*time.Second)
+	if err != nil {
+		p.mu.Lock()
+		p.created--
+		p.mu.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// warm dials up to p.min connections and returns them to the idle pool,
+// so MinPoolSize is actually honored as a floor instead of only bounding
+// p.max. It's called once a host's monitor check confirms it's reachable;
+// dial failures are silently dropped, since the monitor will retry.
+func (p *backendConnPool) warm() {
+	p.mu.Lock()
+	need := p.min - p.created
+	if need <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.created += need
+	p.mu.Unlock()
+
+	for i := 0; i < need; i++ {
+		conn, err := net.DialTimeout("tcp", p.address, 10*time.Second)
+		if err != nil {
+			p.mu.Lock()
+			p.created--
+			p.mu.Unlock()
+			continue
+		}
+		p.put(conn)
+	}
+}
+
+func (p *backendConnPool) put(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= p.max && p.max > 0 {
+		c.Close()
+		p.created--
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+func (p *backendConnPool) discard(c net.Conn) {
+	c.Close()
+	p.mu.Lock()
+	p.created--
+	p.mu.Unlock()
+}
+
+// BackendPool tracks SDAM-style server descriptions for every host in a
+// replica set or sharded connection string and selects a backend per
+// client message using standard read-preference rules, with a connection
+// pool per backend and a background monitor that keeps descriptions fresh.
+type BackendPool struct {
+	config BackendConfig
+	hosts  []string
+
+	mu      sync.RWMutex
+	servers map[string]ServerDescription
+	pools   map[string]*backendConnPool
+
+	stop chan struct{}
+}
+
+// NewBackendPool parses the connection string's host list and starts the
+// background monitor that keeps server descriptions fresh via periodic
+// hello/ismaster calls.
+func NewBackendPool(config BackendConfig) (*BackendPool, error) {
+	hosts, err := parseHostList(config.URI)
+	if err != nil {
+		return nil, err
+	}
+	if config.HeartbeatFrequencyMS == 0 {
+		config.HeartbeatFrequencyMS = 10000
+	}
+
+	bp := &BackendPool{
+		config:  config,
+		hosts:   hosts,
+		servers: map[string]ServerDescription{},
+		pools:   map[string]*backendConnPool{},
+		stop:    make(chan struct{}),
+	}
+	for _, h := range hosts {
+		bp.pools[h] = newBackendConnPool(h, config.MinPoolSize, config.MaxPoolSize)
+	}
+
+	go bp.monitor()
+	return bp, nil
+}
+
+// parseHostList extracts the comma-separated host:port list from a
+// mongodb:// connection string, ignoring auth credentials and options —
+// all the pool needs in order to dial and send hello.
+func parseHostList(uri string) ([]string, error) {
+	rest := strings.TrimPrefix(uri, "mongodb://")
+	if rest == uri {
+		return nil, fmt.Errorf("backendpool: unsupported connection string scheme: %v", uri)
+	}
+	if idx := strings.Index(rest, "@"); idx >= 0 {
+		rest = rest[idx+1:]
+	}
+	if idx := strings.IndexAny(rest, "/?"); idx >= 0 {
+		rest = rest[:idx]
+	}
+	var hosts []string
+	for _, h := range strings.Split(rest, ",") {
+		if h == "" {
+			continue
+		}
+		if !strings.Contains(h, ":") {
+			h = h + ":27017"
+		}
+		hosts = append(hosts, h)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("backendpool: no hosts found in connection string")
+	}
+	return hosts, nil
+}
+
+func (bp *BackendPool) monitor() {
+	ticker := time.NewTicker(time.Duration(bp.config.HeartbeatFrequencyMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	bp.refreshAll()
+	for {
+		select {
+		case <-ticker.C:
+			bp.refreshAll()
+		case <-bp.stop:
+			return
+		}
+	}
+}
+
+func (bp *BackendPool) refreshAll() {
+	for _, h := range bp.hosts {
+		go bp.refreshOne(h)
+	}
+}
+
+func (bp *BackendPool) refreshOne(address string) {
+	start := time.Now()
+	reply, err := sendHello(address)
+	if err != nil {
+		bp.mu.Lock()
+		bp.servers[address] = ServerDescription{Address: address, Type: ServerTypeUnknown, LastUpdateTime: time.Now()}
+		bp.mu.Unlock()
+		return
+	}
+	sd := newServerDescriptionFromHello(address, reply)
+	sd.recordRTT(time.Since(start))
+
+	bp.mu.Lock()
+	if prev, ok := bp.servers[address]; ok {
+		merged := make([]int64, 0, len(prev.rttSamples)+len(sd.rttSamples))
+		merged = append(merged, prev.rttSamples...)
+		merged = append(merged, sd.rttSamples...)
+		if len(merged) > maxRTTSamples {
+			merged = merged[len(merged)-maxRTTSamples:]
+		}
+		sd.rttSamples = merged
+	}
+	bp.servers[address] = sd
+	bp.mu.Unlock()
+
+	bp.mu.RLock()
+	pool, ok := bp.pools[address]
+	bp.mu.RUnlock()
+	if ok {
+		go pool.warm()
+	}
+}
+
+// Stop halts the background monitor. It does not close pooled connections.
+func (bp *BackendPool) Stop() {
+	close(bp.stop)
+}
+
+// SelectBackend applies rp against the current server descriptions and
+// returns the address of a suitable backend.
+func (bp *BackendPool) SelectBackend(rp ReadPreference) (string, error) {
+	bp.mu.RLock()
+	servers := make([]ServerDescription, 0, len(bp.servers))
+	for _, s := range bp.servers {
+		servers = append(servers, s)
+	}
+	bp.mu.RUnlock()
+
+	candidates := SelectServer(servers, rp)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("backendpool: no server available for read preference %+v", rp)
+	}
+	// candidates are all within the latency window of each other, so pick
+	// at random instead of always hammering the first one (see
+	// latencyWindow's doc comment).
+	return candidates[rand.Intn(len(candidates))].Address, nil
+}
+
+// GetConn checks out a pooled connection to address.
+func (bp *BackendPool) GetConn(address string) (net.Conn, error) {
+	bp.mu.RLock()
+	pool, ok := bp.pools[address]
+	bp.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("backendpool: unknown backend %v", address)
+	}
+	return pool.get()
+}
+
+// PutConn returns a connection to its pool for reuse.
+func (bp *BackendPool) PutConn(address string, c net.Conn) {
+	bp.mu.RLock()
+	pool, ok := bp.pools[address]
+	bp.mu.RUnlock()
+	if !ok {
+		c.Close()
+		return
+	}
+	pool.put(c)
+}
+
+// DiscardConn closes a connection instead of returning it to the pool,
+// e.g. after a socket error during a command.
+func (bp *BackendPool) DiscardConn(address string, c net.Conn) {
+	bp.mu.RLock()
+	pool, ok := bp.pools[address]
+	bp.mu.RUnlock()
+	if !ok {
+		c.Close()
+		return
+	}
+	pool.discard(c)
+}
+
+// MarkStale forces a server description back to Unknown, so the next
+// SelectBackend call won't route to it until the monitor refreshes it —
+// used after a socket returns a "not master" style error.
+func (bp *BackendPool) MarkStale(address string) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if sd, ok := bp.servers[address]; ok {
+		sd.Type = ServerTypeUnknown
+		bp.servers[address] = sd
+	}
+	go bp.refreshOne(address)
+}
+
+// IsRetryableRoutingError reports whether code (typically a
+// CommandReplyMessage's top-level or write error code) indicates the
+// command should be rerouted to a freshly-selected primary rather than
+// surfaced to the client.
+func IsRetryableRoutingError(code int) bool {
+	return notMasterCodes[code]
+}
+
+// sendHello issues a minimal isMaster handshake against address over its
+// own short-lived connection (rather than borrowing from the pool, so
+// monitoring never contends with command traffic) and returns the parsed
+// reply document.
+func sendHello(address string) (bson.D, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := writeIsMasterQuery(conn); err != nil {
+		return nil, err
+	}
+	return readOpReply(conn)
+}
+
+// writeIsMasterQuery hand-assembles a minimal OP_QUERY isMaster command
+// against admin.$cmd, since the monitor dials outside of any ProxySession
+// and has no Message/MessageHeader to reuse.
+func writeIsMasterQuery(conn net.Conn) error {
+	query, err := bson.Marshal(bson.D{{"isMaster", 1}})
+	if err != nil {
+		return err
+	}
+
+	const opQuery = 2004
+	ns := append([]byte("admin.$cmd"), 0)
+
+	body := make([]byte, 0, 4+len(ns)+4+4+len(query))
+	body = appendInt32(body, 0) // flags
+	body = append(body, ns...)
+	body = appendInt32(body, 0)  // numberToSkip
+	body = appendInt32(body, -1) // numberToReturn
+	body = append(body, query...)
+
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(16+len(body)))
+	binary.LittleEndian.PutUint32(header[4:8], 0)  // requestID
+	binary.LittleEndian.PutUint32(header[8:12], 0) // responseTo
+	binary.LittleEndian.PutUint32(header[12:16], uint32(opQuery))
+
+	_, err = conn.Write(append(header, body...))
+	return err
+}
+
+func appendInt32(buf []byte, v int32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return append(buf, b...)
+}
+
+// readOpReply reads a single OP_REPLY off conn and returns its document.
+// It only understands enough of the legacy reply shape to pull the first
+// (and for isMaster, only) document out.
+func readOpReply(conn net.Conn) (bson.D, error) {
+	header := make([]byte, 16)
+	if _, err := readFull(conn, header); err != nil {
+		return nil, err
+	}
+	size := int32(binary.LittleEndian.Uint32(header[0:4]))
+	if size < 16 {
+		return nil, fmt.Errorf("backendpool: invalid OP_REPLY size %v", size)
+	}
+
+	rest := make([]byte, size-16)
+	if _, err := readFull(conn, rest); err != nil {
+		return nil, err
+	}
+
+	// OP_REPLY body: responseFlags(4) cursorID(8) startingFrom(4) numberReturned(4) docs...
+	if len(rest) < 20 {
+		return nil, fmt.Errorf("backendpool: truncated OP_REPLY")
+	}
+	docBytes := rest[20:]
+
+	var doc bson.D
+	if err := bson.Unmarshal(docBytes, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,72 @@
+package mongonet
+
+import (
+	"net"
+	"testing"
+)
+
+// TestSelectBackendPicksAcrossLatencyWindow asserts SelectBackend doesn't
+// always hand back the same server when several are within the latency
+// window of each other (see latencyWindow's doc comment on why always
+// picking the first candidate would defeat its purpose).
+func TestSelectBackendPicksAcrossLatencyWindow(t *testing.T) {
+	bp := &BackendPool{
+		servers: map[string]ServerDescription{
+			"a:1": {Address: "a:1", Type: ServerTypeRSPrimary, rttSamples: []int64{int64(1 * 1e6)}},
+			"b:1": {Address: "b:1", Type: ServerTypeRSPrimary, rttSamples: []int64{int64(2 * 1e6)}},
+			"c:1": {Address: "c:1", Type: ServerTypeRSPrimary, rttSamples: []int64{int64(3 * 1e6)}},
+		},
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		address, err := bp.SelectBackend(ReadPreference{Mode: "primary"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		seen[address] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected SelectBackend to pick across multiple candidates in the latency window over repeated calls, only saw %v", seen)
+	}
+}
+
+func TestBackendConnPoolWarmFillsToMin(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn
+		}
+	}()
+
+	p := newBackendConnPool(ln.Addr().String(), 3, 10)
+	p.warm()
+
+	p.mu.Lock()
+	idle := len(p.idle)
+	created := p.created
+	p.mu.Unlock()
+	if idle != 3 || created != 3 {
+		t.Fatalf("expected 3 idle/created connections after warm, got idle=%v created=%v", idle, created)
+	}
+}
+
+func TestBackendConnPoolWarmNoopWhenAlreadyAtMin(t *testing.T) {
+	p := newBackendConnPool("127.0.0.1:0", 0, 10)
+	p.warm()
+
+	p.mu.Lock()
+	created := p.created
+	p.mu.Unlock()
+	if created != 0 {
+		t.Fatalf("expected no connections dialed when min is 0, got created=%v", created)
+	}
+}
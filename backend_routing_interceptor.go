@@ -0,0 +1,143 @@
+package mongonet
+
+import (
+	"net"
+	"time"
+)
+
+// BackendRoutingInterceptor wraps another ProxyInterceptor and, before
+// delegating to it, resolves the backend a command should be routed to
+// via a BackendPool, based on the command's $readPreference, and checks
+// out a connection to that backend. The returned ResponseInterceptor
+// implements RoutedConn, exposing that connection and its address;
+// ProxySession does not consult it, so the command is still sent over
+// (and the reply read from) the session's own backend connection, and
+// the checked-out connection is returned to the pool (or discarded)
+// unused. When a reply carries a
+// retryable "not master" style error, the selected backend is marked
+// stale so later commands route to a freshly-selected primary instead —
+// this interceptor does not itself resend the failed command; the reply
+// the client already received stands. A nil pool disables routing
+// (InterceptClientToMongo passes straight through), the same "zero value
+// means off" convention CompressionSession and MultiObserver use, so this
+// interceptor is safe to leave in a chain before a BackendPool is
+// configured.
+type BackendRoutingInterceptor struct {
+	wrapped ProxyInterceptor
+	pool    *BackendPool
+}
+
+func NewBackendRoutingInterceptor(wrapped ProxyInterceptor, pool *BackendPool) *BackendRoutingInterceptor {
+	return &BackendRoutingInterceptor{wrapped, pool}
+}
+
+func (bri *BackendRoutingInterceptor) Close() {
+	bri.wrapped.Close()
+}
+
+func (bri *BackendRoutingInterceptor) TrackRequest(h MessageHeader) {
+	bri.wrapped.TrackRequest(h)
+}
+
+func (bri *BackendRoutingInterceptor) TrackResponse(h MessageHeader) {
+	bri.wrapped.TrackResponse(h)
+}
+
+func (bri *BackendRoutingInterceptor) CheckConnection() error {
+	return bri.wrapped.CheckConnection()
+}
+
+func (bri *BackendRoutingInterceptor) CheckConnectionInterval() time.Duration {
+	return bri.wrapped.CheckConnectionInterval()
+}
+
+func (bri *BackendRoutingInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	if bri.pool == nil {
+		return bri.wrapped.InterceptClientToMongo(m)
+	}
+
+	cmdDoc, _, err := extractCommandDoc(m)
+	if err != nil || cmdDoc == nil {
+		return bri.wrapped.InterceptClientToMongo(m)
+	}
+
+	rp := ParseReadPreference(cmdDoc)
+	address, err := bri.pool.SelectBackend(rp)
+	if err != nil {
+		return m, nil, err
+	}
+
+	conn, err := bri.pool.GetConn(address)
+	if err != nil {
+		return m, nil, err
+	}
+
+	next, ri, werr := bri.wrapped.InterceptClientToMongo(m)
+	if werr != nil {
+		bri.pool.PutConn(address, conn)
+		return next, ri, werr
+	}
+
+	return next, &reroutingResponseInterceptor{bri.pool, address, conn, ri}, nil
+}
+
+// RoutedConn is implemented by a ResponseInterceptor that selected a
+// specific backend connection for this command cycle. ProxySession does
+// not type-assert for it; nothing in the send path uses Conn().
+type RoutedConn interface {
+	Conn() net.Conn
+	Address() string
+}
+
+// reroutingResponseInterceptor carries the backend connection selected for
+// this command (exposed via RoutedConn), returns it to the pool once the cycle
+// completes, and marks the selected backend stale and discards the
+// connection instead when the reply carries a "not master" style error
+// code — so a future command picks a freshly-selected primary. It does
+// not retry or resend the current command itself; that reply is still
+// returned to the client unchanged.
+type reroutingResponseInterceptor struct {
+	pool    *BackendPool
+	address string
+	conn    net.Conn
+	wrapped ResponseInterceptor
+}
+
+func (rri *reroutingResponseInterceptor) Conn() net.Conn {
+	return rri.conn
+}
+
+func (rri *reroutingResponseInterceptor) Address() string {
+	return rri.address
+}
+
+func (rri *reroutingResponseInterceptor) InterceptMongoToClient(m Message) (Message, error) {
+	out := m
+	var err error
+	if rri.wrapped != nil {
+		out, err = rri.wrapped.InterceptMongoToClient(m)
+	}
+
+	if err != nil {
+		rri.pool.DiscardConn(rri.address, rri.conn)
+		return out, err
+	}
+
+	stale := false
+	if reply, ok := out.(*CommandReplyMessage); ok {
+		for _, code := range replyErrorCodes(reply) {
+			if IsRetryableRoutingError(code) {
+				rri.pool.MarkStale(rri.address)
+				stale = true
+			}
+		}
+	}
+
+	if stale {
+		rri.pool.DiscardConn(rri.address, rri.conn)
+	} else {
+		rri.pool.PutConn(rri.address, rri.conn)
+	}
+
+	return out, err
+}
@@ -0,0 +1,40 @@
+package mongonet
+
+import (
+	"testing"
+	"time"
+)
+
+type stubInterceptor struct {
+	calls int
+}
+
+func (s *stubInterceptor) Close()                                 {}
+func (s *stubInterceptor) TrackRequest(MessageHeader)             {}
+func (s *stubInterceptor) TrackResponse(MessageHeader)            {}
+func (s *stubInterceptor) CheckConnection() error                 { return nil }
+func (s *stubInterceptor) CheckConnectionInterval() time.Duration { return 0 }
+func (s *stubInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	s.calls++
+	return m, nil, nil
+}
+
+func TestBackendRoutingInterceptorNilPoolPassesThrough(t *testing.T) {
+	wrapped := &stubInterceptor{}
+	bri := NewBackendRoutingInterceptor(wrapped, nil)
+	if _, _, err := bri.InterceptClientToMongo(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wrapped.calls != 1 {
+		t.Fatalf("expected pass-through to call wrapped once, got %v", wrapped.calls)
+	}
+}
+
+func TestReroutingResponseInterceptorImplementsRoutedConn(t *testing.T) {
+	var _ RoutedConn = &reroutingResponseInterceptor{}
+
+	rri := &reroutingResponseInterceptor{address: "127.0.0.1:1"}
+	if rri.Address() != "127.0.0.1:1" {
+		t.Fatalf("unexpected address: %v", rri.Address())
+	}
+}
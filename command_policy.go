@@ -0,0 +1,460 @@
+package mongonet
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v2"
+)
+
+// PolicyAction is the outcome a CommandPolicyRule applies to a matching
+// command.
+type PolicyAction string
+
+const (
+	PolicyAllow   PolicyAction = "allow"
+	PolicyDeny    PolicyAction = "deny"
+	PolicyRewrite PolicyAction = "rewrite"
+	PolicyAudit   PolicyAction = "audit"
+)
+
+// CommandPolicyRule matches commands by name, namespace glob, presence of
+// specific BSON fields, or document size, and applies an action when it
+// matches.
+type CommandPolicyRule struct {
+	Name            string
+	Action          PolicyAction
+	Commands        []string
+	NamespaceGlob   string
+	DenyFields      []string
+	RequireFields   []string
+	MaxDocumentSize int
+	User            string
+	Rewrite         bson.D
+}
+
+// commandPolicyRuleFields mirrors CommandPolicyRule field-for-field except
+// for Rewrite: bson.D is a slice (`type D []E`), which neither
+// encoding/json nor yaml.v2 can unmarshal a mapping into directly. Config
+// loading instead decodes the rewrite block into a generic map/MapSlice
+// here and converts it to a bson.D afterwards.
+type commandPolicyRuleFields struct {
+	Name            string       `yaml:"name" json:"name"`
+	Action          PolicyAction `yaml:"action" json:"action"`
+	Commands        []string     `yaml:"commands" json:"commands"`
+	NamespaceGlob   string       `yaml:"namespace" json:"namespace"`
+	DenyFields      []string     `yaml:"denyFields" json:"denyFields"`
+	RequireFields   []string     `yaml:"requireFields" json:"requireFields"`
+	MaxDocumentSize int          `yaml:"maxDocumentSize" json:"maxDocumentSize"`
+	User            string       `yaml:"user" json:"user"`
+	Rewrite         interface{}  `yaml:"rewrite" json:"rewrite"`
+}
+
+func (f commandPolicyRuleFields) toRule() CommandPolicyRule {
+	return CommandPolicyRule{
+		Name:            f.Name,
+		Action:          f.Action,
+		Commands:        f.Commands,
+		NamespaceGlob:   f.NamespaceGlob,
+		DenyFields:      f.DenyFields,
+		RequireFields:   f.RequireFields,
+		MaxDocumentSize: f.MaxDocumentSize,
+		User:            f.User,
+		Rewrite:         toBSOND(f.Rewrite),
+	}
+}
+
+// toBSOND recursively converts the generic map/slice shapes that
+// encoding/json and yaml.v2 decode mappings into (map[string]interface{}
+// and yaml.MapSlice/map[interface{}]interface{}, respectively) into
+// bson.D, so a "rewrite" config block can be used as a command document.
+func toBSOND(v interface{}) bson.D {
+	switch vv := v.(type) {
+	case bson.D:
+		return vv
+	case yaml.MapSlice:
+		out := make(bson.D, 0, len(vv))
+		for _, item := range vv {
+			out = append(out, bson.E{fmt.Sprintf("%v", item.Key), toBSONValue(item.Value)})
+		}
+		return out
+	case map[string]interface{}:
+		out := make(bson.D, 0, len(vv))
+		for k, val := range vv {
+			out = append(out, bson.E{k, toBSONValue(val)})
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(bson.D, 0, len(vv))
+		for k, val := range vv {
+			out = append(out, bson.E{fmt.Sprintf("%v", k), toBSONValue(val)})
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+// toBSONValue applies toBSOND's mapping conversion recursively to a single
+// decoded value, leaving scalars and arrays of scalars untouched.
+func toBSONValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case yaml.MapSlice, map[string]interface{}, map[interface{}]interface{}:
+		return toBSOND(vv)
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i, elem := range vv {
+			out[i] = toBSONValue(elem)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// UnmarshalYAML decodes a rule's fields normally but routes its "rewrite"
+// block through toBSOND, since bson.D can't be unmarshaled into directly.
+func (r *CommandPolicyRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var fields commandPolicyRuleFields
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	*r = fields.toRule()
+	return nil
+}
+
+// UnmarshalJSON decodes a rule's fields normally but routes its "rewrite"
+// block through toBSOND, since bson.D can't be unmarshaled into directly.
+func (r *CommandPolicyRule) UnmarshalJSON(data []byte) error {
+	var fields commandPolicyRuleFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*r = fields.toRule()
+	return nil
+}
+
+// CommandPolicyConfig is the top-level YAML/JSON document describing a
+// CommandPolicy.
+type CommandPolicyConfig struct {
+	DryRun bool                `yaml:"dryRun" json:"dryRun"`
+	Rules  []CommandPolicyRule `yaml:"rules" json:"rules"`
+}
+
+// LoadCommandPolicyYAML parses a YAML-formatted policy document.
+func LoadCommandPolicyYAML(data []byte) (CommandPolicyConfig, error) {
+	var cfg CommandPolicyConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("commandpolicy: invalid YAML: %v", err)
+	}
+	return cfg, nil
+}
+
+// LoadCommandPolicyJSON parses a JSON-formatted policy document.
+func LoadCommandPolicyJSON(data []byte) (CommandPolicyConfig, error) {
+	var cfg CommandPolicyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("commandpolicy: invalid JSON: %v", err)
+	}
+	return cfg, nil
+}
+
+// AuditEvent describes one policy decision, whether or not it denied the
+// command.
+type AuditEvent struct {
+	Timestamp  time.Time
+	ClientAddr string
+	User       string
+	DB         string
+	Collection string
+	Command    string
+	RuleName   string
+	Action     PolicyAction
+	DryRun     bool
+}
+
+// AuditSink streams policy decisions somewhere durable: a file, syslog, or
+// a message queue like Kafka.
+type AuditSink interface {
+	Write(event AuditEvent) error
+}
+
+// FileAuditSink appends a JSON line per decision to an io.Writer-backed
+// file.
+type FileAuditSink struct {
+	w fileWriter
+}
+
+type fileWriter interface {
+	Write(p []byte) (int, error)
+}
+
+func NewFileAuditSink(w fileWriter) *FileAuditSink {
+	return &FileAuditSink{w}
+}
+
+func (fs *FileAuditSink) Write(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = fs.w.Write(line)
+	return err
+}
+
+// SyslogAuditSink forwards decisions to a syslog writer (anything
+// implementing the same minimal interface as log/syslog.Writer).
+type SyslogAuditSink struct {
+	w fileWriter
+}
+
+func NewSyslogAuditSink(w fileWriter) *SyslogAuditSink {
+	return &SyslogAuditSink{w}
+}
+
+func (ss *SyslogAuditSink) Write(event AuditEvent) error {
+	_, err := ss.w.Write([]byte(fmt.Sprintf(
+		"mongonet-policy rule=%v action=%v user=%v db=%v collection=%v command=%v dryRun=%v\n",
+		event.RuleName, event.Action, event.User, event.DB, event.Collection, event.Command, event.DryRun)))
+	return err
+}
+
+// KafkaProducer is the minimal subset of a Kafka producer client the proxy
+// needs, so this package doesn't have to depend on a specific Kafka
+// driver.
+type KafkaProducer interface {
+	Produce(topic string, key, value []byte) error
+}
+
+// KafkaAuditSink publishes one JSON message per decision to a Kafka topic.
+type KafkaAuditSink struct {
+	producer KafkaProducer
+	topic    string
+}
+
+func NewKafkaAuditSink(producer KafkaProducer, topic string) *KafkaAuditSink {
+	return &KafkaAuditSink{producer, topic}
+}
+
+func (ks *KafkaAuditSink) Write(event AuditEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return ks.producer.Produce(ks.topic, []byte(event.RuleName), value)
+}
+
+// CommandPolicy evaluates a command against an ordered list of rules. The
+// first matching rule wins.
+type CommandPolicy struct {
+	Rules  []CommandPolicyRule
+	DryRun bool
+	Audit  AuditSink
+}
+
+// evaluate returns the first rule that matches cmdDoc/ns/user, or nil if
+// none do (an implicit allow).
+func (cp *CommandPolicy) evaluate(cmdName, ns, user string, cmdDoc bson.D) *CommandPolicyRule {
+	for i := range cp.Rules {
+		rule := &cp.Rules[i]
+		if !rule.matches(cmdName, ns, user, cmdDoc) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+func (r *CommandPolicyRule) matches(cmdName, ns, user string, cmdDoc bson.D) bool {
+	if len(r.Commands) > 0 && !stringSliceContains(r.Commands, cmdName) {
+		return false
+	}
+	if r.NamespaceGlob != "" {
+		if ok, _ := path.Match(r.NamespaceGlob, ns); !ok {
+			return false
+		}
+	}
+	if r.User != "" {
+		if ok, _ := path.Match(r.User, user); !ok {
+			return false
+		}
+	}
+	for _, f := range r.DenyFields {
+		if BSONIndexOf(cmdDoc, f) >= 0 {
+			return true
+		}
+	}
+	for _, f := range r.RequireFields {
+		if BSONIndexOf(cmdDoc, f) < 0 {
+			return true
+		}
+	}
+	if r.MaxDocumentSize > 0 {
+		if encoded, err := bson.Marshal(cmdDoc); err == nil && len(encoded) > r.MaxDocumentSize {
+			return true
+		}
+	}
+	// a rule with only command/namespace/user matchers and no field/size
+	// predicates matches unconditionally, e.g. a blanket "deny mapReduce"
+	if len(r.DenyFields) == 0 && len(r.RequireFields) == 0 && r.MaxDocumentSize == 0 {
+		return true
+	}
+	return false
+}
+
+// CommandPolicyInterceptor wraps another ProxyInterceptor and enforces a
+// CommandPolicy before delegating to it: denied commands short-circuit
+// with a synthesized ProxyPolicyDenied error, and every decision streams
+// to the configured AuditSink. In dry-run mode, deny rules only audit.
+type CommandPolicyInterceptor struct {
+	wrapped ProxyInterceptor
+	ps      *ProxySession
+	policy  *CommandPolicy
+
+	// user is populated from saslStart/saslContinue commands observed on
+	// this connection, so later rules can match on authenticated user.
+	user string
+}
+
+// NewCommandPolicyInterceptor wraps an existing ProxyInterceptor with
+// CommandPolicy enforcement, the same chain-of-responsibility pattern
+// every other interceptor in this package follows. ps is kept so audit
+// events can record the client's remote address.
+func NewCommandPolicyInterceptor(wrapped ProxyInterceptor, ps *ProxySession, policy *CommandPolicy) *CommandPolicyInterceptor {
+	return &CommandPolicyInterceptor{wrapped: wrapped, ps: ps, policy: policy}
+}
+
+func (cpi *CommandPolicyInterceptor) Close() {
+	cpi.wrapped.Close()
+}
+
+func (cpi *CommandPolicyInterceptor) TrackRequest(h MessageHeader) {
+	cpi.wrapped.TrackRequest(h)
+}
+
+func (cpi *CommandPolicyInterceptor) TrackResponse(h MessageHeader) {
+	cpi.wrapped.TrackResponse(h)
+}
+
+func (cpi *CommandPolicyInterceptor) CheckConnection() error {
+	return cpi.wrapped.CheckConnection()
+}
+
+func (cpi *CommandPolicyInterceptor) CheckConnectionInterval() time.Duration {
+	return cpi.wrapped.CheckConnectionInterval()
+}
+
+func (cpi *CommandPolicyInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	cmdDoc, ns, err := extractCommandDoc(m)
+	if err != nil || cmdDoc == nil {
+		return cpi.wrapped.InterceptClientToMongo(m)
+	}
+
+	cmdName := strings.ToLower(cmdDoc[0].Key)
+	if cmdName == "saslstart" || cmdName == "saslcontinue" {
+		if user := extractSASLUser(cmdDoc); user != "" {
+			cpi.user = user
+		}
+		return cpi.wrapped.InterceptClientToMongo(m)
+	}
+
+	db, collection := splitNamespace(ns)
+	rule := cpi.policy.evaluate(cmdName, ns, cpi.user, cmdDoc)
+	if rule == nil {
+		return cpi.wrapped.InterceptClientToMongo(m)
+	}
+
+	cpi.audit(rule, cmdName, db, collection)
+
+	if rule.Action == PolicyDeny && !cpi.policy.DryRun {
+		merr := NewMongoErrorWithInfo(
+			fmt.Errorf("command denied by policy rule %q", rule.Name),
+			8000, "ProxyPolicyDenied", rule.Name)
+		return cpi.synthesizeDenyReply(m, merr), nil, nil
+	}
+
+	if rule.Action == PolicyRewrite && !cpi.policy.DryRun {
+		if err := rewriteCommandDoc(m, rule.Rewrite); err != nil {
+			return m, nil, err
+		}
+	}
+
+	return cpi.wrapped.InterceptClientToMongo(m)
+}
+
+func (cpi *CommandPolicyInterceptor) audit(rule *CommandPolicyRule, cmdName, db, collection string) {
+	if cpi.policy.Audit == nil {
+		return
+	}
+	cpi.policy.Audit.Write(AuditEvent{
+		Timestamp:  time.Now(),
+		ClientAddr: cpi.clientAddr(),
+		User:       cpi.user,
+		DB:         db,
+		Collection: collection,
+		Command:    cmdName,
+		RuleName:   rule.Name,
+		Action:     rule.Action,
+		DryRun:     cpi.policy.DryRun,
+	})
+}
+
+// clientAddr returns the remote address of the connection this
+// interceptor is attached to, or "" when it wasn't built with a
+// ProxySession (e.g. a unit test exercising the interceptor directly).
+func (cpi *CommandPolicyInterceptor) clientAddr() string {
+	if cpi.ps == nil {
+		return ""
+	}
+	return cpi.ps.RemoteAddr().String()
+}
+
+// synthesizeDenyReply builds a CommandReplyMessage carrying merr's BSON in
+// place of forwarding the command to the backend.
+func (cpi *CommandPolicyInterceptor) synthesizeDenyReply(m Message, merr MongoError) Message {
+	errBSON, err := SimpleBSONConvert(merr.ToBSON())
+	if err != nil {
+		return m
+	}
+	return &CommandReplyMessage{
+		header:       m.Header(),
+		CommandReply: errBSON,
+	}
+}
+
+func stringSliceContains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// extractSASLUser pulls the "user" field, or else the username embedded in
+// a SCRAM "payload" as its "n=" attribute, out of a saslStart/saslContinue
+// command, so policy rules can match on authenticated user without the
+// proxy fully terminating auth itself.
+func extractSASLUser(cmdDoc bson.D) string {
+	if idx := BSONIndexOf(cmdDoc, "user"); idx >= 0 {
+		if s, ok := cmdDoc[idx].Value.(string); ok {
+			return s
+		}
+	}
+	if idx := BSONIndexOf(cmdDoc, "payload"); idx >= 0 {
+		if bin, ok := cmdDoc[idx].Value.(primitive.Binary); ok {
+			for _, attr := range strings.Split(string(bin.Data), ",") {
+				if strings.HasPrefix(attr, "n=") {
+					return attr[len("n="):]
+				}
+			}
+		}
+	}
+	return ""
+}
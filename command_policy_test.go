@@ -0,0 +1,215 @@
+package mongonet
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// capturingInterceptor records the last message it was handed, so tests
+// can assert whether CommandPolicyInterceptor forwarded it unchanged,
+// rewritten, or not at all.
+type capturingInterceptor struct {
+	calls int
+	last  Message
+}
+
+func (c *capturingInterceptor) Close()                                 {}
+func (c *capturingInterceptor) TrackRequest(MessageHeader)             {}
+func (c *capturingInterceptor) TrackResponse(MessageHeader)            {}
+func (c *capturingInterceptor) CheckConnection() error                 { return nil }
+func (c *capturingInterceptor) CheckConnectionInterval() time.Duration { return 0 }
+func (c *capturingInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	c.calls++
+	c.last = m
+	return m, nil, nil
+}
+
+func newTestFindQuery(t *testing.T, doc bson.D) *QueryMessage {
+	t.Helper()
+	qb, err := SimpleBSONConvert(doc)
+	if err != nil {
+		t.Fatalf("unexpected error building query: %v", err)
+	}
+	return &QueryMessage{Namespace: "test.$cmd", Query: qb}
+}
+
+func TestCommandPolicyInterceptorDeny(t *testing.T) {
+	wrapped := &capturingInterceptor{}
+	policy := &CommandPolicy{
+		Rules: []CommandPolicyRule{
+			{Name: "no-where", Action: PolicyDeny, Commands: []string{"find"}, DenyFields: []string{"$where"}},
+		},
+	}
+	cpi := NewCommandPolicyInterceptor(wrapped, nil, policy)
+
+	msg := newTestFindQuery(t, bson.D{{"find", "coll"}, {"$where", "this.a == 1"}})
+	reply, ri, err := cpi.InterceptClientToMongo(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ri != nil {
+		t.Fatalf("expected no response interceptor for a denied command")
+	}
+	if wrapped.calls != 0 {
+		t.Fatalf("expected denied command not to reach the wrapped interceptor")
+	}
+	crm, ok := reply.(*CommandReplyMessage)
+	if !ok {
+		t.Fatalf("expected a synthesized CommandReplyMessage, got %T", reply)
+	}
+	errDoc, err := crm.CommandReply.ToBSOND()
+	if err != nil {
+		t.Fatalf("unexpected error decoding synthesized reply: %v", err)
+	}
+	if codeName := errDoc[BSONIndexOf(errDoc, "codeName")].Value; codeName != "ProxyPolicyDenied" {
+		t.Fatalf("expected codeName ProxyPolicyDenied, got %v", codeName)
+	}
+}
+
+func TestCommandPolicyInterceptorDryRunOnlyAudits(t *testing.T) {
+	wrapped := &capturingInterceptor{}
+	policy := &CommandPolicy{
+		DryRun: true,
+		Rules: []CommandPolicyRule{
+			{Name: "no-where", Action: PolicyDeny, Commands: []string{"find"}, DenyFields: []string{"$where"}},
+		},
+	}
+	cpi := NewCommandPolicyInterceptor(wrapped, nil, policy)
+
+	msg := newTestFindQuery(t, bson.D{{"find", "coll"}, {"$where", "this.a == 1"}})
+	if _, _, err := cpi.InterceptClientToMongo(msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wrapped.calls != 1 {
+		t.Fatalf("expected dry-run to still forward the command, got %v calls", wrapped.calls)
+	}
+	if wrapped.last != msg {
+		t.Fatalf("expected dry-run to forward the original message unchanged")
+	}
+}
+
+func TestCommandPolicyInterceptorRewrite(t *testing.T) {
+	wrapped := &capturingInterceptor{}
+	policy := &CommandPolicy{
+		Rules: []CommandPolicyRule{
+			{
+				Name:     "cap-limit",
+				Action:   PolicyRewrite,
+				Commands: []string{"find"},
+				Rewrite:  bson.D{{"find", "coll"}, {"limit", int32(10)}},
+			},
+		},
+	}
+	cpi := NewCommandPolicyInterceptor(wrapped, nil, policy)
+
+	msg := newTestFindQuery(t, bson.D{{"find", "coll"}, {"limit", int32(10000)}})
+	if _, _, err := cpi.InterceptClientToMongo(msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wrapped.calls != 1 {
+		t.Fatalf("expected rewritten command to still be forwarded, got %v calls", wrapped.calls)
+	}
+	forwarded, ok := wrapped.last.(*QueryMessage)
+	if !ok {
+		t.Fatalf("expected a *QueryMessage, got %T", wrapped.last)
+	}
+	doc, err := forwarded.Query.ToBSOND()
+	if err != nil {
+		t.Fatalf("unexpected error decoding rewritten query: %v", err)
+	}
+	if limit := doc[BSONIndexOf(doc, "limit")].Value; limit != int32(10) {
+		t.Fatalf("expected rewritten limit 10, got %v", limit)
+	}
+}
+
+func TestLoadCommandPolicyYAMLRewrite(t *testing.T) {
+	cfg, err := LoadCommandPolicyYAML([]byte(`
+dryRun: false
+rules:
+  - name: cap-limit
+    action: rewrite
+    commands: ["find"]
+    rewrite:
+      find: coll
+      limit: 10
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Rules) != 1 {
+		t.Fatalf("expected 1 rule, got %v", len(cfg.Rules))
+	}
+	rewrite := cfg.Rules[0].Rewrite
+	if rewrite == nil {
+		t.Fatalf("expected a non-nil rewrite doc")
+	}
+	if idx := BSONIndexOf(rewrite, "find"); idx < 0 || rewrite[idx].Value != "coll" {
+		t.Fatalf("expected rewrite.find == \"coll\", got %v", rewrite)
+	}
+	if idx := BSONIndexOf(rewrite, "limit"); idx < 0 || rewrite[idx].Value != 10 {
+		t.Fatalf("expected rewrite.limit == 10, got %v", rewrite)
+	}
+}
+
+func TestLoadCommandPolicyJSONRewrite(t *testing.T) {
+	cfg, err := LoadCommandPolicyJSON([]byte(`{
+		"dryRun": false,
+		"rules": [{
+			"name": "cap-limit",
+			"action": "rewrite",
+			"commands": ["find"],
+			"rewrite": {"find": "coll", "limit": 10}
+		}]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Rules) != 1 {
+		t.Fatalf("expected 1 rule, got %v", len(cfg.Rules))
+	}
+	rewrite := cfg.Rules[0].Rewrite
+	if rewrite == nil {
+		t.Fatalf("expected a non-nil rewrite doc")
+	}
+	if idx := BSONIndexOf(rewrite, "find"); idx < 0 || rewrite[idx].Value != "coll" {
+		t.Fatalf("expected rewrite.find == \"coll\", got %v", rewrite)
+	}
+	if idx := BSONIndexOf(rewrite, "limit"); idx < 0 || rewrite[idx].Value != float64(10) {
+		t.Fatalf("expected rewrite.limit == 10, got %v", rewrite)
+	}
+}
+
+func TestCommandPolicyDenyWhereOperator(t *testing.T) {
+	policy := &CommandPolicy{
+		Rules: []CommandPolicyRule{
+			{Name: "no-where", Action: PolicyDeny, Commands: []string{"find"}, DenyFields: []string{"$where"}},
+		},
+	}
+
+	denied := bson.D{{"find", "coll"}, {"$where", "this.a == 1"}}
+	if rule := policy.evaluate("find", "test.coll", "", denied); rule == nil || rule.Name != "no-where" {
+		t.Fatalf("expected no-where rule to match $where query")
+	}
+
+	allowed := bson.D{{"find", "coll"}, {"filter", bson.D{{"a", 1}}}}
+	if rule := policy.evaluate("find", "test.coll", "", allowed); rule != nil {
+		t.Fatalf("expected filtered find not to match, got rule %v", rule.Name)
+	}
+}
+
+func TestCommandPolicyNamespaceGlob(t *testing.T) {
+	policy := &CommandPolicy{
+		Rules: []CommandPolicyRule{
+			{Name: "deny-admin", Action: PolicyDeny, NamespaceGlob: "admin.*"},
+		},
+	}
+
+	if rule := policy.evaluate("find", "admin.system.users", "", bson.D{{"find", "system.users"}}); rule == nil {
+		t.Fatalf("expected deny-admin rule to match admin namespace")
+	}
+	if rule := policy.evaluate("find", "test.coll", "", bson.D{{"find", "coll"}}); rule != nil {
+		t.Fatalf("expected test.coll not to match admin-only rule")
+	}
+}
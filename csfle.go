@@ -0,0 +1,837 @@
+package mongonet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AEAD algorithm names, as used in EncryptedField.Algorithm.
+const (
+	DeterministicAlgorithm = "AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic"
+	RandomAlgorithm        = "AEAD_AES_256_CBC_HMAC_SHA_512-Random"
+)
+
+// EncryptedField describes how a single field in a namespace should be
+// encrypted/decrypted as it passes through the proxy.
+type EncryptedField struct {
+	KeyId     primitive.Binary // subtype 4 (UUID) data key id
+	Algorithm string           // "AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic" or "...-Random"
+	BsonType  string           // expected plaintext bson type, e.g. "string", "int"
+}
+
+// EncryptedFieldsMap maps a fully qualified namespace ("db.collection") to
+// the set of dotted field paths that must be encrypted/decrypted.
+type EncryptedFieldsMap map[string]map[string]EncryptedField
+
+// KMSProviderConfig holds credentials for the supported KMS providers. Only
+// the fields for the configured provider need to be set.
+type KMSProviderConfig struct {
+	Local *LocalKMSConfig
+	AWS   *AWSKMSConfig
+	GCP   *GCPKMSConfig
+	Azure *AzureKMSConfig
+}
+
+type LocalKMSConfig struct {
+	Key []byte // 96 byte master key
+}
+
+type AWSKMSConfig struct {
+	AccessKeyId     string
+	SecretAccessKey string
+}
+
+type GCPKMSConfig struct {
+	Email      string
+	PrivateKey []byte
+}
+
+type AzureKMSConfig struct {
+	TenantId     string
+	ClientId     string
+	ClientSecret string
+}
+
+// dataKeyCacheEntry caches a decrypted data key so repeated encrypt/decrypt
+// calls for the same keyId don't each require a KMS round-trip.
+type dataKeyCacheEntry struct {
+	key       []byte
+	expiresAt time.Time
+}
+
+// dataKeyCache is a simple TTL cache of decrypted data keys, keyed by the
+// data key's UUID (as a string so primitive.Binary can be used as a map key).
+type dataKeyCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]dataKeyCacheEntry
+}
+
+func newDataKeyCache(ttl time.Duration) *dataKeyCache {
+	return &dataKeyCache{
+		ttl:     ttl,
+		entries: map[string]dataKeyCacheEntry{},
+	}
+}
+
+func (c *dataKeyCache) get(keyId primitive.Binary) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[string(keyId.Data)]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.key, true
+}
+
+func (c *dataKeyCache) put(keyId primitive.Binary, key []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[string(keyId.Data)] = dataKeyCacheEntry{key, time.Now().Add(c.ttl)}
+}
+
+// DataKeyFetcher resolves the raw key vault document for a data key id.
+// The proxy has no standing connection of its own to the key vault
+// namespace, so callers must supply one (typically backed by a mongo
+// client pointed at KeyVaultNamespace); a nil KeyVault leaves decryption
+// disabled and every encrypt/decrypt call fails closed.
+type DataKeyFetcher interface {
+	FetchDataKeyDoc(keyId primitive.Binary) (bson.D, error)
+}
+
+// EncryptionConfig is the CSFLE configuration passed to
+// NewEncryptionInterceptor. ProxyConfig has no field that carries it.
+type EncryptionConfig struct {
+	SchemaMap         EncryptedFieldsMap
+	KMSProviders      KMSProviderConfig
+	KeyVaultNamespace string // "db.collection" holding the data keys
+	KeyVault          DataKeyFetcher
+	DataKeyCacheTTL   time.Duration
+}
+
+// encryptionCommands are the commands whose BSON bodies may contain
+// fields that need to be walked for encryption.
+var encryptionCommands = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"find":          true,
+	"aggregate":     true,
+	"findandmodify": true,
+}
+
+// EncryptionInterceptor is a ProxyInterceptor that transparently encrypts
+// outgoing fields and decrypts incoming ones according to an
+// EncryptedFieldsMap, so that clients speaking to the proxy don't need to
+// embed the driver's ClientEncryption helper.
+type EncryptionInterceptor struct {
+	wrapped ProxyInterceptor
+	ps      *ProxySession
+	config  EncryptionConfig
+	cache   *dataKeyCache
+}
+
+// NewEncryptionInterceptor wraps an existing ProxyInterceptor with CSFLE
+// encryption/decryption, the same chain-of-responsibility pattern every
+// other interceptor in this package follows, so it can be composed with
+// (and sit anywhere in) a real interceptor chain.
+func NewEncryptionInterceptor(wrapped ProxyInterceptor, ps *ProxySession, config EncryptionConfig) *EncryptionInterceptor {
+	ttl := config.DataKeyCacheTTL
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	return &EncryptionInterceptor{wrapped, ps, config, newDataKeyCache(ttl)}
+}
+
+func (ei *EncryptionInterceptor) Close() {
+	ei.wrapped.Close()
+}
+
+func (ei *EncryptionInterceptor) TrackRequest(h MessageHeader) {
+	ei.wrapped.TrackRequest(h)
+}
+
+func (ei *EncryptionInterceptor) TrackResponse(h MessageHeader) {
+	ei.wrapped.TrackResponse(h)
+}
+
+func (ei *EncryptionInterceptor) CheckConnection() error {
+	return ei.wrapped.CheckConnection()
+}
+
+func (ei *EncryptionInterceptor) CheckConnectionInterval() time.Duration {
+	return ei.wrapped.CheckConnectionInterval()
+}
+
+func (ei *EncryptionInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	cmdDoc, ns, err := extractCommandDoc(m)
+	if err != nil || cmdDoc == nil {
+		return ei.wrapped.InterceptClientToMongo(m)
+	}
+
+	cmdName := strings.ToLower(cmdDoc[0].Key)
+	if !encryptionCommands[cmdName] {
+		return ei.wrapped.InterceptClientToMongo(m)
+	}
+
+	fields := ei.config.SchemaMap[ns]
+	if len(fields) == 0 {
+		return ei.wrapped.InterceptClientToMongo(m)
+	}
+
+	encrypted, err := ei.walkAndEncrypt(cmdName, cmdDoc, fields)
+	if err != nil {
+		return m, nil, fmt.Errorf("csfle: failed to encrypt %v.%v: %v", ns, cmdName, err)
+	}
+
+	if err := rewriteCommandDoc(m, encrypted); err != nil {
+		return m, nil, err
+	}
+
+	next, ri, werr := ei.wrapped.InterceptClientToMongo(m)
+	if werr != nil {
+		return next, ri, werr
+	}
+
+	return next, &decryptingResponseInterceptor{ei, fields, ri}, nil
+}
+
+// envelopeTargets maps, for each encryption-eligible command, the
+// top-level field that carries the user document(s) the EncryptedFieldsMap
+// describes — "documents" for insert, "filter" for find, etc. — to the
+// sub-key (if any) that holds the actual document within each array
+// element; "" means the array element (or the field itself) is the
+// document. Schema paths are relative to these user documents, not the
+// command envelope, so walkAndEncrypt unwraps down to them before matching
+// fields against a path.
+var envelopeTargets = map[string]map[string]string{
+	"insert":        {"documents": ""},
+	"update":        {"updates": "u"},
+	"find":          {"filter": ""},
+	"aggregate":     {"pipeline": ""},
+	"findandmodify": {"query": "", "update": ""},
+}
+
+// operatorKeys are update-modifier and aggregation-stage operator names
+// whose value is itself a fields-document at the *same* schema level as
+// their parent, not a schema level of its own — e.g. the "ssn" in
+// {"$set": {"ssn": ...}} or {"$match": {"ssn": ...}} lives at the same
+// path "ssn" the schema describes, not "$set.ssn"/"$match.ssn".
+// walkAndEncryptDoc special-cases these keys so the operator name itself
+// never becomes part of a matched path.
+var operatorKeys = map[string]bool{
+	// update operators
+	"$set": true, "$unset": true, "$inc": true, "$mul": true, "$min": true, "$max": true,
+	"$currentDate": true, "$push": true, "$addToSet": true, "$pull": true, "$pullAll": true,
+	"$rename": true, "$setOnInsert": true,
+	// aggregation stage operators
+	"$match": true, "$group": true, "$project": true, "$addFields": true,
+	"$replaceRoot": true, "$replaceWith": true,
+}
+
+// walkAndEncrypt unwraps cmdDoc's envelope for cmdName down to the user
+// document(s) it carries and replaces plaintext values at fields' dotted
+// paths with subtype-6 ciphertext binaries. Envelope keys that aren't
+// where a command's user documents live (e.g. insert's "ordered") pass
+// through unchanged.
+func (ei *EncryptionInterceptor) walkAndEncrypt(cmdName string, doc bson.D, fields map[string]EncryptedField) (bson.D, error) {
+	targets := envelopeTargets[cmdName]
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		subKey, ok := targets[elem.Key]
+		if !ok {
+			out = append(out, elem)
+			continue
+		}
+		rewritten, err := ei.unwrapAndEncrypt(elem.Value, fields, subKey)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bson.E{elem.Key, rewritten})
+	}
+	return out, nil
+}
+
+// unwrapAndEncrypt walks down through arrays (e.g. insert's "documents",
+// update's "updates") and, once subKey is reached (e.g. an update entry's
+// "u"), encrypts the user document found there against fields at the
+// top-level prefix.
+func (ei *EncryptionInterceptor) unwrapAndEncrypt(value interface{}, fields map[string]EncryptedField, subKey string) (interface{}, error) {
+	switch v := value.(type) {
+	case primitive.A:
+		out := make(primitive.A, len(v))
+		for i, elem := range v {
+			rewritten, err := ei.unwrapAndEncrypt(elem, fields, subKey)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rewritten
+		}
+		return out, nil
+	case bson.D:
+		if subKey == "" {
+			return ei.walkAndEncryptDoc(v, fields, "")
+		}
+		out := make(bson.D, 0, len(v))
+		for _, elem := range v {
+			if elem.Key != subKey {
+				out = append(out, elem)
+				continue
+			}
+			rewritten, err := ei.unwrapAndEncrypt(elem.Value, fields, "")
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{elem.Key, rewritten})
+		}
+		return out, nil
+	default:
+		return value, nil
+	}
+}
+
+// walkAndEncryptDoc replaces plaintext values at fields' dotted paths with
+// subtype-6 ciphertext binaries, recursing into both nested sub-documents
+// and arrays of sub-documents (which share their parent field's path,
+// since an array doesn't introduce a new schema level).
+func (ei *EncryptionInterceptor) walkAndEncryptDoc(doc bson.D, fields map[string]EncryptedField, prefix string) (bson.D, error) {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		if operatorKeys[elem.Key] {
+			if sub, ok := elem.Value.(bson.D); ok {
+				rewritten, err := ei.walkAndEncryptDoc(sub, fields, prefix)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, bson.E{elem.Key, rewritten})
+				continue
+			}
+		}
+		path := elem.Key
+		if prefix != "" {
+			path = prefix + "." + elem.Key
+		}
+		if spec, ok := fields[path]; ok {
+			ct, err := ei.encryptValue(spec, elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{elem.Key, ct})
+			continue
+		}
+		switch sub := elem.Value.(type) {
+		case bson.D:
+			rewritten, err := ei.walkAndEncryptDoc(sub, fields, path)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{elem.Key, rewritten})
+		case primitive.A:
+			rewritten, err := ei.walkAndEncryptArray(sub, fields, path)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{elem.Key, rewritten})
+		default:
+			out = append(out, elem)
+		}
+	}
+	return out, nil
+}
+
+// walkAndEncryptArray recurses into bson.D elements of arr, leaving other
+// elements (scalars, nested arrays of scalars) unchanged.
+func (ei *EncryptionInterceptor) walkAndEncryptArray(arr primitive.A, fields map[string]EncryptedField, path string) (primitive.A, error) {
+	out := make(primitive.A, len(arr))
+	for i, elem := range arr {
+		if sub, ok := elem.(bson.D); ok {
+			rewritten, err := ei.walkAndEncryptDoc(sub, fields, path)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rewritten
+			continue
+		}
+		out[i] = elem
+	}
+	return out, nil
+}
+
+// encryptValue resolves the data key via the cache (fetching and unwrapping
+// it through the configured KMS provider on a miss), AEAD-encrypts value
+// with it, and shapes the result the way the wire protocol expects it.
+func (ei *EncryptionInterceptor) encryptValue(spec EncryptedField, value interface{}) (primitive.Binary, error) {
+	key, ok := ei.cache.get(spec.KeyId)
+	if !ok {
+		fetched, err := ei.fetchDataKey(spec.KeyId)
+		if err != nil {
+			return primitive.Binary{}, err
+		}
+		key = fetched
+		ei.cache.put(spec.KeyId, key)
+	}
+	ciphertext, err := aeadEncrypt(key, spec.Algorithm, value)
+	if err != nil {
+		return primitive.Binary{}, err
+	}
+	return primitive.Binary{Subtype: 6, Data: ciphertext}, nil
+}
+
+// fetchDataKey resolves a data key document from the key vault namespace
+// via ei.config.KeyVault and unwraps its keyMaterial with whichever KMS
+// provider created it.
+func (ei *EncryptionInterceptor) fetchDataKey(keyId primitive.Binary) ([]byte, error) {
+	if ei.config.KeyVault == nil {
+		return nil, fmt.Errorf("csfle: no KeyVault configured to resolve data keys from %v", ei.config.KeyVaultNamespace)
+	}
+	doc, err := ei.config.KeyVault.FetchDataKeyDoc(keyId)
+	if err != nil {
+		return nil, fmt.Errorf("csfle: failed to fetch data key from %v: %v", ei.config.KeyVaultNamespace, err)
+	}
+	return unwrapDataKey(ei.config.KMSProviders, doc)
+}
+
+// unwrapDataKey decrypts a key vault document's keyMaterial with whichever
+// KMS provider created it, as named in the document's masterKey.provider
+// field. Only the Local provider is implemented: AWS/GCP/Azure each
+// require an outbound call to their own KMS API, which this proxy doesn't
+// make on its own, so those providers fail closed with a clear error
+// rather than silently miscomputing a result.
+func unwrapDataKey(providers KMSProviderConfig, doc bson.D) ([]byte, error) {
+	m := doc.Map()
+
+	material, ok := m["keyMaterial"].(primitive.Binary)
+	if !ok {
+		return nil, fmt.Errorf("csfle: data key document missing keyMaterial")
+	}
+
+	masterKey, _ := m["masterKey"].(bson.D)
+	provider, _ := masterKey.Map()["provider"].(string)
+
+	switch provider {
+	case "local":
+		if providers.Local == nil {
+			return nil, fmt.Errorf("csfle: data key uses the local KMS provider, but none is configured")
+		}
+		return unwrapLocalDataKey(providers.Local.Key, material.Data)
+	case "aws", "gcp", "azure":
+		return nil, fmt.Errorf("csfle: %v KMS provider is not supported by this proxy", provider)
+	default:
+		return nil, fmt.Errorf("csfle: data key document has unknown KMS provider %q", provider)
+	}
+}
+
+// unwrapLocalDataKey decrypts a key vault document's keyMaterial using the
+// Local KMS provider's master key, via the same AEAD_AES_256_CBC_HMAC_SHA_512
+// construction used for field values (the master key standing in for a
+// data key).
+func unwrapLocalDataKey(masterKey, wrapped []byte) ([]byte, error) {
+	return aeadOpen(masterKey, wrapped)
+}
+
+// aeadEncrypt AEAD-encrypts value (marshaled as a one-field BSON document
+// so its original type survives the round trip) with key, per the
+// Deterministic/Random algorithms CSFLE defines.
+func aeadEncrypt(key []byte, algorithm string, value interface{}) ([]byte, error) {
+	if len(key) != aeadKeyLen {
+		return nil, fmt.Errorf("csfle: AEAD key must be %v bytes, got %v", aeadKeyLen, len(key))
+	}
+	plaintext, err := bson.Marshal(bson.D{{"v", value}})
+	if err != nil {
+		return nil, fmt.Errorf("csfle: failed to marshal plaintext value: %v", err)
+	}
+
+	var iv [aes.BlockSize]byte
+	switch algorithm {
+	case DeterministicAlgorithm:
+		mac := hmac.New(sha256.New, key[:32])
+		mac.Write(plaintext)
+		copy(iv[:], mac.Sum(nil))
+	case RandomAlgorithm:
+		if _, err := rand.Read(iv[:]); err != nil {
+			return nil, fmt.Errorf("csfle: failed to generate IV: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("csfle: unknown algorithm %q", algorithm)
+	}
+
+	return aeadSeal(key, iv[:], plaintext)
+}
+
+// aeadDecrypt reverses aeadEncrypt, returning the original typed value.
+func aeadDecrypt(key []byte, ciphertext []byte) (interface{}, error) {
+	plaintext, err := aeadOpen(key, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	var wrapper bson.D
+	if err := bson.Unmarshal(plaintext, &wrapper); err != nil {
+		return nil, fmt.Errorf("csfle: failed to unmarshal decrypted value: %v", err)
+	}
+	idx := BSONIndexOf(wrapper, "v")
+	if idx < 0 {
+		return nil, fmt.Errorf("csfle: decrypted document missing value")
+	}
+	return wrapper[idx].Value, nil
+}
+
+// aeadKeyLen is the length of a CSFLE data key or KMS master key: a 32-byte
+// HMAC key, a 32-byte AES key, and 32 reserved (unused) bytes.
+const aeadKeyLen = 96
+
+// aeadSeal implements the generic AEAD_AES_256_CBC_HMAC_SHA_512
+// construction CSFLE uses both to wrap data keys (Local KMS provider) and
+// to encrypt field values: AES-256-CBC over PKCS7-padded plaintext, with
+// an HMAC-SHA512 tag (truncated to 32 bytes) over iv||ciphertext.
+func aeadSeal(key, iv, plaintext []byte) ([]byte, error) {
+	if len(key) != aeadKeyLen {
+		return nil, fmt.Errorf("csfle: AEAD key must be %v bytes, got %v", aeadKeyLen, len(key))
+	}
+	macKey, encKey := key[:32], key[32:64]
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	padded := pkcs7Pad(plaintext, aes.BlockSize)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	mac := hmac.New(sha512.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	tag := mac.Sum(nil)[:32]
+
+	out := make([]byte, 0, len(iv)+len(ciphertext)+len(tag))
+	out = append(out, iv...)
+	out = append(out, ciphertext...)
+	out = append(out, tag...)
+	return out, nil
+}
+
+// aeadOpen reverses aeadSeal, verifying the HMAC tag before decrypting.
+func aeadOpen(key, sealed []byte) ([]byte, error) {
+	if len(key) != aeadKeyLen {
+		return nil, fmt.Errorf("csfle: AEAD key must be %v bytes, got %v", aeadKeyLen, len(key))
+	}
+	if len(sealed) < aes.BlockSize+32 || (len(sealed)-aes.BlockSize-32)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("csfle: malformed ciphertext")
+	}
+	macKey, encKey := key[:32], key[32:64]
+
+	iv := sealed[:aes.BlockSize]
+	tag := sealed[len(sealed)-32:]
+	ciphertext := sealed[aes.BlockSize : len(sealed)-32]
+
+	mac := hmac.New(sha512.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil)[:32], tag) {
+		return nil, fmt.Errorf("csfle: HMAC verification failed")
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(padded, ciphertext)
+	return pkcs7Unpad(padded)
+}
+
+func pkcs7Pad(buf []byte, blockSize int) []byte {
+	padLen := blockSize - len(buf)%blockSize
+	padded := make([]byte, len(buf)+padLen)
+	copy(padded, buf)
+	for i := len(buf); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	return padded
+}
+
+func pkcs7Unpad(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || len(buf)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("csfle: invalid padded ciphertext length")
+	}
+	padLen := int(buf[len(buf)-1])
+	if padLen == 0 || padLen > aes.BlockSize || padLen > len(buf) {
+		return nil, fmt.Errorf("csfle: invalid PKCS7 padding")
+	}
+	for _, b := range buf[len(buf)-padLen:] {
+		if int(b) != padLen {
+			return nil, fmt.Errorf("csfle: invalid PKCS7 padding")
+		}
+	}
+	return buf[:len(buf)-padLen], nil
+}
+
+// decryptingResponseInterceptor walks a CommandReplyMessage's OutputDocs on
+// the way back to the client and decrypts any subtype-6 binaries at the
+// namespace's configured field paths.
+type decryptingResponseInterceptor struct {
+	ei      *EncryptionInterceptor
+	fields  map[string]EncryptedField
+	wrapped ResponseInterceptor
+}
+
+func (dri *decryptingResponseInterceptor) InterceptMongoToClient(m Message) (Message, error) {
+	out := m
+	if dri.wrapped != nil {
+		var err error
+		out, err = dri.wrapped.InterceptMongoToClient(m)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	reply, ok := out.(*CommandReplyMessage)
+	if !ok {
+		return out, nil
+	}
+
+	for i, doc := range reply.OutputDocs {
+		d, err := doc.ToBSOND()
+		if err != nil {
+			return m, err
+		}
+		decrypted, err := dri.walkAndDecryptReply(d)
+		if err != nil {
+			return m, fmt.Errorf("csfle: failed to decrypt output doc: %v", err)
+		}
+		sb, err := SimpleBSONConvert(decrypted)
+		if err != nil {
+			return m, err
+		}
+		reply.OutputDocs[i] = sb
+	}
+
+	return reply, nil
+}
+
+// walkAndDecryptReply mirrors envelopeTargets for command replies: it
+// decrypts the result documents in the "cursor.firstBatch"/
+// "cursor.nextBatch" arrays a find/aggregate/getMore reply carries, and
+// the single document a findAndModify reply returns in "value". These keys
+// are checked regardless of the original command, since a reply missing
+// them is just left alone.
+func (dri *decryptingResponseInterceptor) walkAndDecryptReply(doc bson.D) (bson.D, error) {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		switch elem.Key {
+		case "cursor":
+			if sub, ok := elem.Value.(bson.D); ok {
+				rewritten, err := dri.walkAndDecryptCursor(sub)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, bson.E{elem.Key, rewritten})
+				continue
+			}
+		case "value":
+			if sub, ok := elem.Value.(bson.D); ok {
+				rewritten, err := dri.walkAndDecryptDoc(sub, "")
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, bson.E{elem.Key, rewritten})
+				continue
+			}
+		}
+		out = append(out, elem)
+	}
+	return out, nil
+}
+
+func (dri *decryptingResponseInterceptor) walkAndDecryptCursor(doc bson.D) (bson.D, error) {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		if elem.Key == "firstBatch" || elem.Key == "nextBatch" {
+			if arr, ok := elem.Value.(primitive.A); ok {
+				rewritten, err := dri.walkAndDecryptArray(arr, "")
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, bson.E{elem.Key, rewritten})
+				continue
+			}
+		}
+		out = append(out, elem)
+	}
+	return out, nil
+}
+
+// walkAndDecryptDoc decrypts subtype-6 binaries at fields' dotted paths,
+// recursing into both nested sub-documents and arrays of sub-documents
+// (which share their parent field's path, mirroring walkAndEncryptDoc).
+func (dri *decryptingResponseInterceptor) walkAndDecryptDoc(doc bson.D, prefix string) (bson.D, error) {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		path := elem.Key
+		if prefix != "" {
+			path = prefix + "." + elem.Key
+		}
+		if spec, ok := dri.fields[path]; ok {
+			if bin, ok := elem.Value.(primitive.Binary); ok && bin.Subtype == 6 {
+				key, ok := dri.ei.cache.get(spec.KeyId)
+				if !ok {
+					fetched, err := dri.ei.fetchDataKey(spec.KeyId)
+					if err != nil {
+						return nil, err
+					}
+					key = fetched
+					dri.ei.cache.put(spec.KeyId, key)
+				}
+				plain, err := aeadDecrypt(key, bin.Data)
+				if err != nil {
+					return nil, err
+				}
+				if spec.BsonType != "" && !matchesBSONType(bson.D{{"$$type", spec.BsonType}}, plain) {
+					return nil, fmt.Errorf("csfle: decrypted value at %v does not match expected bson type %v", path, spec.BsonType)
+				}
+				out = append(out, bson.E{elem.Key, plain})
+				continue
+			}
+		}
+		switch sub := elem.Value.(type) {
+		case bson.D:
+			rewritten, err := dri.walkAndDecryptDoc(sub, path)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{elem.Key, rewritten})
+		case primitive.A:
+			rewritten, err := dri.walkAndDecryptArray(sub, path)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{elem.Key, rewritten})
+		default:
+			out = append(out, elem)
+		}
+	}
+	return out, nil
+}
+
+// walkAndDecryptArray recurses into bson.D elements of arr, leaving other
+// elements unchanged.
+func (dri *decryptingResponseInterceptor) walkAndDecryptArray(arr primitive.A, prefix string) (primitive.A, error) {
+	out := make(primitive.A, len(arr))
+	for i, elem := range arr {
+		if sub, ok := elem.(bson.D); ok {
+			rewritten, err := dri.walkAndDecryptDoc(sub, prefix)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rewritten
+			continue
+		}
+		out[i] = elem
+	}
+	return out, nil
+}
+
+// extractCommandDoc pulls the command document and target namespace out of
+// either wire shape the proxy understands. It returns a nil doc for
+// messages that aren't commands.
+func extractCommandDoc(m Message) (bson.D, string, error) {
+	switch mm := m.(type) {
+	case *QueryMessage:
+		if !NamespaceIsCommand(mm.Namespace) {
+			return nil, "", nil
+		}
+		doc, err := mm.Query.ToBSOND()
+		if err != nil || len(doc) == 0 {
+			return nil, "", err
+		}
+		db := strings.TrimSuffix(mm.Namespace, ".$cmd")
+		coll, ok := bsonValueAsString(doc, 0)
+		if !ok {
+			return doc, db, nil
+		}
+		return doc, db + "." + coll, nil
+	case *OpMsg:
+		doc, err := mm.BodyDoc.ToBSOND()
+		if err != nil || len(doc) == 0 {
+			return nil, "", err
+		}
+		dbIdx := BSONIndexOf(doc, "$db")
+		if dbIdx < 0 {
+			return doc, "", nil
+		}
+		db, _ := doc[dbIdx].Value.(string)
+		coll, _ := doc[0].Value.(string)
+		return doc, db + "." + coll, nil
+	}
+	return nil, "", nil
+}
+
+func bsonValueAsString(doc bson.D, idx int) (string, bool) {
+	if idx < 0 || idx >= len(doc) {
+		return "", false
+	}
+	s, ok := doc[idx].Value.(string)
+	return s, ok
+}
+
+// matchesBSONType implements the "$$type" assertion form used by the
+// encryption spec tests, e.g. {"$$type": "binData"}, so schema validation
+// can be reused against expected-shape assertions in test fixtures.
+func matchesBSONType(assertion bson.D, value interface{}) bool {
+	idx := BSONIndexOf(assertion, "$$type")
+	if idx < 0 {
+		return false
+	}
+	wantType, ok := assertion[idx].Value.(string)
+	if !ok {
+		return false
+	}
+	switch wantType {
+	case "binData":
+		_, ok := value.(primitive.Binary)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "int":
+		_, ok := value.(int32)
+		return ok
+	case "long":
+		_, ok := value.(int64)
+		return ok
+	case "double":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return false
+	}
+}
+
+// rewriteCommandDoc writes an updated command document back into the
+// message it was extracted from.
+func rewriteCommandDoc(m Message, doc bson.D) error {
+	switch mm := m.(type) {
+	case *QueryMessage:
+		qb, err := SimpleBSONConvert(doc)
+		if err != nil {
+			return err
+		}
+		mm.Query = qb
+	case *OpMsg:
+		bb, err := SimpleBSONConvert(doc)
+		if err != nil {
+			return err
+		}
+		mm.BodyDoc = bb
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package mongonet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testDataKey() []byte {
+	key := make([]byte, aeadKeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestAEADDeterministicRoundTrip(t *testing.T) {
+	key := testDataKey()
+	ct, err := aeadEncrypt(key, DeterministicAlgorithm, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	plain, err := aeadDecrypt(key, ct)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plain != "hello" {
+		t.Fatalf("expected %q, got %v", "hello", plain)
+	}
+
+	// deterministic mode must produce identical ciphertext for the same
+	// plaintext and key, so equality queries still work against it.
+	ct2, err := aeadEncrypt(key, DeterministicAlgorithm, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(ct, ct2) {
+		t.Fatalf("expected deterministic ciphertext to repeat")
+	}
+}
+
+func TestAEADRandomRoundTrip(t *testing.T) {
+	key := testDataKey()
+	ct1, err := aeadEncrypt(key, RandomAlgorithm, int32(17))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ct2, err := aeadEncrypt(key, RandomAlgorithm, int32(17))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(ct1, ct2) {
+		t.Fatalf("expected random ciphertext to differ between calls")
+	}
+
+	plain, err := aeadDecrypt(key, ct1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plain != int32(17) {
+		t.Fatalf("expected 17, got %v", plain)
+	}
+}
+
+func TestAEADDecryptRejectsTamperedCiphertext(t *testing.T) {
+	key := testDataKey()
+	ct, err := aeadEncrypt(key, RandomAlgorithm, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ct[len(ct)-1] ^= 0xFF
+	if _, err := aeadDecrypt(key, ct); err == nil {
+		t.Fatalf("expected tampered ciphertext to fail HMAC verification")
+	}
+}
+
+func TestUnwrapLocalDataKeyRoundTrip(t *testing.T) {
+	masterKey := testDataKey()
+	dataKey := bytes.Repeat([]byte{0x42}, aeadKeyLen)
+
+	iv := make([]byte, aes.BlockSize)
+	wrapped, err := aeadSeal(masterKey, iv, dataKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	unwrapped, err := unwrapLocalDataKey(masterKey, wrapped)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("expected unwrapped key to match original data key")
+	}
+}
+
+func TestWalkAndEncryptInsertThenDecryptFindReply(t *testing.T) {
+	keyId := primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}
+	ei := &EncryptionInterceptor{cache: newDataKeyCache(time.Minute)}
+	ei.cache.put(keyId, testDataKey())
+
+	fields := map[string]EncryptedField{
+		"ssn": {KeyId: keyId, Algorithm: DeterministicAlgorithm, BsonType: "string"},
+	}
+
+	insertCmd := bson.D{
+		{"insert", "people"},
+		{"documents", primitive.A{
+			bson.D{{"name", "alice"}, {"ssn", "111-11-1111"}},
+		}},
+		{"ordered", true},
+	}
+
+	encrypted, err := ei.walkAndEncrypt("insert", insertCmd, fields)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	docs, ok := encrypted[1].Value.(primitive.A)
+	if !ok || len(docs) != 1 {
+		t.Fatalf("expected documents array to survive encryption, got %v", encrypted[1].Value)
+	}
+	doc, ok := docs[0].(bson.D)
+	if !ok {
+		t.Fatalf("expected a bson.D document, got %T", docs[0])
+	}
+	ssnIdx := BSONIndexOf(doc, "ssn")
+	bin, ok := doc[ssnIdx].Value.(primitive.Binary)
+	if !ok || bin.Subtype != 6 {
+		t.Fatalf("expected ssn to be encrypted as subtype 6 binary, got %v", doc[ssnIdx].Value)
+	}
+	if name := doc[BSONIndexOf(doc, "name")].Value; name != "alice" {
+		t.Fatalf("expected name to be left alone, got %v", name)
+	}
+
+	dri := &decryptingResponseInterceptor{ei: ei, fields: fields}
+	reply := bson.D{
+		{"cursor", bson.D{
+			{"firstBatch", primitive.A{doc}},
+			{"id", int64(0)},
+		}},
+		{"ok", 1},
+	}
+	decrypted, err := dri.walkAndDecryptReply(reply)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cursor, ok := decrypted[0].Value.(bson.D)
+	if !ok {
+		t.Fatalf("expected cursor doc, got %T", decrypted[0].Value)
+	}
+	batch, ok := cursor[BSONIndexOf(cursor, "firstBatch")].Value.(primitive.A)
+	if !ok || len(batch) != 1 {
+		t.Fatalf("expected firstBatch array to survive decryption, got %v", cursor)
+	}
+	outDoc, ok := batch[0].(bson.D)
+	if !ok {
+		t.Fatalf("expected a bson.D document, got %T", batch[0])
+	}
+	if ssn := outDoc[BSONIndexOf(outDoc, "ssn")].Value; ssn != "111-11-1111" {
+		t.Fatalf("expected decrypted ssn %q, got %v", "111-11-1111", ssn)
+	}
+}
+
+func TestWalkAndEncryptUpdateModifier(t *testing.T) {
+	keyId := primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}
+	ei := &EncryptionInterceptor{cache: newDataKeyCache(time.Minute)}
+	ei.cache.put(keyId, testDataKey())
+
+	fields := map[string]EncryptedField{
+		"ssn": {KeyId: keyId, Algorithm: DeterministicAlgorithm, BsonType: "string"},
+	}
+
+	updateCmd := bson.D{
+		{"update", "people"},
+		{"updates", primitive.A{
+			bson.D{
+				{"q", bson.D{{"name", "alice"}}},
+				{"u", bson.D{{"$set", bson.D{{"ssn", "111-11-1111"}}}}},
+			},
+		}},
+	}
+
+	encrypted, err := ei.walkAndEncrypt("update", updateCmd, fields)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updates, ok := encrypted[1].Value.(primitive.A)
+	if !ok || len(updates) != 1 {
+		t.Fatalf("expected updates array to survive encryption, got %v", encrypted[1].Value)
+	}
+	entry, ok := updates[0].(bson.D)
+	if !ok {
+		t.Fatalf("expected a bson.D update entry, got %T", updates[0])
+	}
+	u, ok := entry[BSONIndexOf(entry, "u")].Value.(bson.D)
+	if !ok {
+		t.Fatalf("expected a bson.D \"u\" modifier doc, got %v", entry[BSONIndexOf(entry, "u")].Value)
+	}
+	set, ok := u[BSONIndexOf(u, "$set")].Value.(bson.D)
+	if !ok {
+		t.Fatalf("expected $set to remain a bson.D, got %v", u[BSONIndexOf(u, "$set")].Value)
+	}
+	bin, ok := set[BSONIndexOf(set, "ssn")].Value.(primitive.Binary)
+	if !ok || bin.Subtype != 6 {
+		t.Fatalf("expected ssn inside $set to be encrypted as subtype 6 binary, got %v", set[BSONIndexOf(set, "ssn")].Value)
+	}
+}
+
+func TestWalkAndEncryptAggregatePipelineStage(t *testing.T) {
+	keyId := primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}
+	ei := &EncryptionInterceptor{cache: newDataKeyCache(time.Minute)}
+	ei.cache.put(keyId, testDataKey())
+
+	fields := map[string]EncryptedField{
+		"ssn": {KeyId: keyId, Algorithm: DeterministicAlgorithm, BsonType: "string"},
+	}
+
+	aggCmd := bson.D{
+		{"aggregate", "people"},
+		{"pipeline", primitive.A{
+			bson.D{{"$match", bson.D{{"ssn", "111-11-1111"}}}},
+		}},
+		{"cursor", bson.D{}},
+	}
+
+	encrypted, err := ei.walkAndEncrypt("aggregate", aggCmd, fields)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pipeline, ok := encrypted[1].Value.(primitive.A)
+	if !ok || len(pipeline) != 1 {
+		t.Fatalf("expected pipeline array to survive encryption, got %v", encrypted[1].Value)
+	}
+	stage, ok := pipeline[0].(bson.D)
+	if !ok {
+		t.Fatalf("expected a bson.D pipeline stage, got %T", pipeline[0])
+	}
+	match, ok := stage[BSONIndexOf(stage, "$match")].Value.(bson.D)
+	if !ok {
+		t.Fatalf("expected $match to remain a bson.D, got %v", stage[BSONIndexOf(stage, "$match")].Value)
+	}
+	bin, ok := match[BSONIndexOf(match, "ssn")].Value.(primitive.Binary)
+	if !ok || bin.Subtype != 6 {
+		t.Fatalf("expected ssn inside $match to be encrypted as subtype 6 binary, got %v", match[BSONIndexOf(match, "ssn")].Value)
+	}
+}
+
+func TestMatchesBSONType(t *testing.T) {
+	cases := []struct {
+		wantType string
+		value    interface{}
+		matches  bool
+	}{
+		{"string", "foo", true},
+		{"string", int32(1), false},
+		{"int", int32(1), true},
+		{"long", int64(1), true},
+		{"double", 1.5, true},
+		{"binData", primitive.Binary{Subtype: 6, Data: []byte("x")}, true},
+	}
+	for _, c := range cases {
+		assertion := bson.D{{"$$type", c.wantType}}
+		if got := matchesBSONType(assertion, c.value); got != c.matches {
+			t.Fatalf("matchesBSONType(%v, %v) = %v, want %v", c.wantType, c.value, got, c.matches)
+		}
+	}
+}
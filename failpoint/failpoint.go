@@ -0,0 +1,268 @@
+// Package failpoint implements a mongo-driver-style fail point that can be
+// configured and evaluated entirely in process, modeled after the
+// configureFailPoint admin command mongod exposes when started with
+// enableTestCommands=1. It lets the proxy synthesize the same faults
+// without needing that flag on the backing mongod.
+package failpoint
+
+import (
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Mode controls how many more times a FailPoint should fire.
+type Mode struct {
+	AlwaysOn bool
+	Off      bool
+	Times    int // fire exactly this many more times, then auto-disable
+	Skip     int // skip this many matches before firing
+}
+
+// Data is the fault to apply once a FailPoint matches a command.
+type Data struct {
+	FailCommands      []string
+	ErrorCode         int
+	CloseConnection   bool
+	BlockConnection   bool
+	BlockTimeMS       int
+	WriteConcernError bson.D
+	AppName           string
+}
+
+// FailPoint is an in-memory equivalent of a mongod fail point.
+type FailPoint struct {
+	Name string
+	Mode Mode
+	Data Data
+
+	mu    sync.Mutex
+	skips int
+	fires int
+}
+
+// ConfigureFailPoint builds a FailPoint from a configureFailPoint-shaped
+// command document: {configureFailPoint: <name>, mode: <mode>, data: <data>}.
+func ConfigureFailPoint(cmd bson.D) (*FailPoint, error) {
+	m := cmd.Map()
+
+	name, ok := m["configureFailPoint"].(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("failpoint: configureFailPoint must name a fail point")
+	}
+
+	mode, err := parseMode(m["mode"])
+	if err != nil {
+		return nil, err
+	}
+
+	data := Data{}
+	if raw, ok := m["data"]; ok {
+		dataDoc, err := toBSOND(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failpoint: invalid data: %v", err)
+		}
+		data = parseData(dataDoc)
+	}
+
+	return &FailPoint{Name: name, Mode: mode, Data: data}, nil
+}
+
+func parseMode(raw interface{}) (Mode, error) {
+	switch v := raw.(type) {
+	case string:
+		switch v {
+		case "alwaysOn":
+			return Mode{AlwaysOn: true}, nil
+		case "off":
+			return Mode{Off: true}, nil
+		}
+		return Mode{}, fmt.Errorf("failpoint: unknown mode %q", v)
+	case nil:
+		return Mode{Off: true}, nil
+	default:
+		doc, err := toBSOND(raw)
+		if err != nil {
+			return Mode{}, fmt.Errorf("failpoint: invalid mode: %v", err)
+		}
+		m := doc.Map()
+		mode := Mode{}
+		if times, ok := asInt(m["times"]); ok {
+			mode.Times = times
+		}
+		if skip, ok := asInt(m["skip"]); ok {
+			mode.Skip = skip
+		}
+		return mode, nil
+	}
+}
+
+func parseData(doc bson.D) Data {
+	m := doc.Map()
+	data := Data{}
+	var raw []interface{}
+	switch v := m["failCommands"].(type) {
+	case bson.A:
+		raw = v
+	case []interface{}:
+		raw = v
+	}
+	for _, c := range raw {
+		if s, ok := c.(string); ok {
+			data.FailCommands = append(data.FailCommands, s)
+		}
+	}
+	if code, ok := asInt(m["errorCode"]); ok {
+		data.ErrorCode = code
+	}
+	if v, ok := m["closeConnection"].(bool); ok {
+		data.CloseConnection = v
+	}
+	if v, ok := m["blockConnection"].(bool); ok {
+		data.BlockConnection = v
+	}
+	if ms, ok := asInt(m["blockTimeMS"]); ok {
+		data.BlockTimeMS = ms
+	}
+	if wce, err := toBSOND(m["writeConcernError"]); err == nil {
+		data.WriteConcernError = wce
+	}
+	if v, ok := m["appName"].(string); ok {
+		data.AppName = v
+	}
+	return data
+}
+
+func toBSOND(raw interface{}) (bson.D, error) {
+	switch v := raw.(type) {
+	case bson.D:
+		return v, nil
+	case bson.M:
+		d := make(bson.D, 0, len(v))
+		for k, val := range v {
+			d = append(d, bson.E{k, val})
+		}
+		return d, nil
+	case nil:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("expected a document, got %T", raw)
+	}
+}
+
+func asInt(raw interface{}) (int, bool) {
+	switch v := raw.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// Matches reports whether this fail point applies to cmdName/appName, and
+// if so consumes one activation (counting a firing against Times, or
+// advancing past a configured Skip). Once exhausted, a Times-mode fail
+// point turns itself off.
+func (fp *FailPoint) Matches(cmdName, appName string) bool {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.Mode.Off {
+		return false
+	}
+	if !containsCommand(fp.Data.FailCommands, cmdName) {
+		return false
+	}
+	if fp.Data.AppName != "" && fp.Data.AppName != appName {
+		return false
+	}
+
+	if fp.Mode.AlwaysOn {
+		return true
+	}
+
+	if fp.skips < fp.Mode.Skip {
+		fp.skips++
+		return false
+	}
+
+	if fp.Mode.Times > 0 {
+		if fp.fires >= fp.Mode.Times {
+			return false
+		}
+		fp.fires++
+		if fp.fires >= fp.Mode.Times {
+			fp.Mode.Off = true
+		}
+		return true
+	}
+
+	if fp.Mode.Skip > 0 {
+		// Skip-only mode: once the skip count is satisfied, behave like
+		// alwaysOn indefinitely (matches real mongod skip semantics).
+		return true
+	}
+
+	return false
+}
+
+func containsCommand(cmds []string, cmdName string) bool {
+	for _, c := range cmds {
+		if c == cmdName {
+			return true
+		}
+	}
+	return false
+}
+
+// Registry is a named set of active fail points, analogous to the set
+// mongod tracks internally. It is safe for concurrent use.
+type Registry struct {
+	mu     sync.Mutex
+	byName map[string]*FailPoint
+}
+
+func NewRegistry() *Registry {
+	return &Registry{byName: map[string]*FailPoint{}}
+}
+
+// Configure installs or replaces the named fail point, or removes it if
+// the new configuration's mode is "off".
+func (r *Registry) Configure(cmd bson.D) error {
+	fp, err := ConfigureFailPoint(cmd)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fp.Mode.Off {
+		delete(r.byName, fp.Name)
+		return nil
+	}
+	r.byName[fp.Name] = fp
+	return nil
+}
+
+// Match returns the first active fail point that applies to cmdName/appName.
+func (r *Registry) Match(cmdName, appName string) *FailPoint {
+	r.mu.Lock()
+	fps := make([]*FailPoint, 0, len(r.byName))
+	for _, fp := range r.byName {
+		fps = append(fps, fp)
+	}
+	r.mu.Unlock()
+
+	for _, fp := range fps {
+		if fp.Matches(cmdName, appName) {
+			return fp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package failpoint
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestConfigureFailPointAlwaysOn(t *testing.T) {
+	cmd := bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", "alwaysOn"},
+		{"data", bson.D{
+			{"failCommands", []interface{}{"find"}},
+			{"closeConnection", true},
+		}},
+	}
+	fp, err := ConfigureFailPoint(cmd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !fp.Matches("find", "") {
+		t.Fatalf("expected fail point to match find")
+	}
+	if fp.Matches("insert", "") {
+		t.Fatalf("expected fail point not to match insert")
+	}
+	// alwaysOn never exhausts itself
+	if !fp.Matches("find", "") {
+		t.Fatalf("expected fail point to still match find")
+	}
+}
+
+func TestConfigureFailPointTimes(t *testing.T) {
+	cmd := bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", bson.D{{"times", 2}}},
+		{"data", bson.D{{"failCommands", []interface{}{"find"}}}},
+	}
+	fp, err := ConfigureFailPoint(cmd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if !fp.Matches("find", "") {
+			t.Fatalf("expected match %v to succeed", i)
+		}
+	}
+	if fp.Matches("find", "") {
+		t.Fatalf("expected fail point to be exhausted after 2 matches")
+	}
+}
+
+func TestConfigureFailPointSkip(t *testing.T) {
+	cmd := bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", bson.D{{"skip", 2}}},
+		{"data", bson.D{{"failCommands", []interface{}{"find"}}}},
+	}
+	fp, err := ConfigureFailPoint(cmd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if fp.Matches("find", "") {
+			t.Fatalf("expected match %v to be skipped", i)
+		}
+	}
+	// once the skip count is satisfied, skip-only mode behaves like
+	// alwaysOn indefinitely
+	for i := 0; i < 3; i++ {
+		if !fp.Matches("find", "") {
+			t.Fatalf("expected fail point to fire after skip count satisfied")
+		}
+	}
+}
+
+func TestRegistryOffRemoves(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Configure(bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", "alwaysOn"},
+		{"data", bson.D{{"failCommands", []interface{}{"find"}}}},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Match("find", "") == nil {
+		t.Fatalf("expected fail point to be active")
+	}
+
+	if err := r.Configure(bson.D{
+		{"configureFailPoint", "failCommand"},
+		{"mode", "off"},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Match("find", "") != nil {
+		t.Fatalf("expected fail point to be removed after mode off")
+	}
+}
@@ -0,0 +1,153 @@
+package mongonet
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jr22/mongonet/failpoint"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrFailPointCloseConnection is returned by FailPointInterceptor when an
+// active fail point is configured with closeConnection:true. ProxySession
+// treats it the same as any other transport-level error and drops the
+// client socket.
+var ErrFailPointCloseConnection = errors.New("failpoint: closeConnection")
+
+// FailPointInterceptor wraps another ProxyInterceptor and gives tests (and
+// chaos experiments) a way to inject faults at the proxy layer, without
+// needing enableTestCommands=1 on the backing mongod. It recognizes the
+// admin-only proxyConfigureFailPoint command and otherwise evaluates every
+// client command against the registry before delegating to the wrapped
+// interceptor.
+type FailPointInterceptor struct {
+	wrapped  ProxyInterceptor
+	registry *failpoint.Registry
+
+	// appName is captured once from client.application.name on the
+	// client's initial isMaster/hello handshake — the only command the
+	// wire protocol attaches client metadata to — and reused for every
+	// later Matches() call on this connection, since ordinary commands
+	// never carry it again.
+	appName string
+}
+
+// NewFailPointInterceptor wraps an existing ProxyInterceptor with fail
+// point evaluation, sharing the given registry across a proxy's sessions.
+func NewFailPointInterceptor(wrapped ProxyInterceptor, registry *failpoint.Registry) *FailPointInterceptor {
+	return &FailPointInterceptor{wrapped, registry}
+}
+
+func (fpi *FailPointInterceptor) Close() {
+	fpi.wrapped.Close()
+}
+
+func (fpi *FailPointInterceptor) TrackRequest(h MessageHeader) {
+	fpi.wrapped.TrackRequest(h)
+}
+
+func (fpi *FailPointInterceptor) TrackResponse(h MessageHeader) {
+	fpi.wrapped.TrackResponse(h)
+}
+
+func (fpi *FailPointInterceptor) CheckConnection() error {
+	return fpi.wrapped.CheckConnection()
+}
+
+func (fpi *FailPointInterceptor) CheckConnectionInterval() time.Duration {
+	return fpi.wrapped.CheckConnectionInterval()
+}
+
+func (fpi *FailPointInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	cmdDoc, ns, err := extractCommandDoc(m)
+	if err != nil || cmdDoc == nil {
+		return fpi.wrapped.InterceptClientToMongo(m)
+	}
+
+	cmdName := strings.ToLower(cmdDoc[0].Key)
+
+	if cmdName == "proxyconfigurefailpoint" {
+		if db, _ := splitNamespace(ns); db != "admin" {
+			return m, nil, NewMongoError(errors.New("proxyConfigureFailPoint may only be run against the admin database"), 13, "Unauthorized")
+		}
+		if err := fpi.registry.Configure(renameFirstKey(cmdDoc, "configureFailPoint")); err != nil {
+			return m, nil, NewMongoError(err, 1, "FailPointConfigError")
+		}
+		return fpi.synthesizeOKReply(m), nil, nil
+	}
+
+	if cmdName == "ismaster" || cmdName == "hello" {
+		if appName := bsonDotted(cmdDoc, "client.application.name"); appName != "" {
+			fpi.appName = appName
+		}
+	}
+
+	if fp := fpi.registry.Match(cmdName, fpi.appName); fp != nil {
+		if fp.Data.CloseConnection {
+			return m, nil, ErrFailPointCloseConnection
+		}
+		if fp.Data.BlockConnection && fp.Data.BlockTimeMS > 0 {
+			time.Sleep(time.Duration(fp.Data.BlockTimeMS) * time.Millisecond)
+		}
+		if fp.Data.ErrorCode != 0 {
+			merr := NewMongoError(errors.New("failpoint: "+fp.Name), fp.Data.ErrorCode, "FailPointEnabled")
+			return m, nil, merr
+		}
+	}
+
+	return fpi.wrapped.InterceptClientToMongo(m)
+}
+
+// synthesizeOKReply builds a minimal {ok: 1} CommandReplyMessage in
+// response to the admin-only proxyConfigureFailPoint command, which the
+// backing mongod never sees.
+func (fpi *FailPointInterceptor) synthesizeOKReply(m Message) Message {
+	ok, err := SimpleBSONConvert(okDoc())
+	if err != nil {
+		return m
+	}
+	return &CommandReplyMessage{
+		header:       m.Header(),
+		CommandReply: ok,
+	}
+}
+
+func okDoc() bson.D {
+	return bson.D{{"ok", 1}}
+}
+
+// renameFirstKey returns a copy of doc with its first element's key
+// replaced, so a proxyConfigureFailPoint command can be re-shaped into the
+// configureFailPoint document failpoint.ConfigureFailPoint expects.
+func renameFirstKey(doc bson.D, newKey string) bson.D {
+	out := make(bson.D, len(doc))
+	copy(out, doc)
+	if len(out) > 0 {
+		out[0] = bson.E{newKey, out[0].Value}
+	}
+	return out
+}
+
+// bsonDotted resolves a dotted path (e.g. "client.application.name")
+// against a document, returning "" if any segment is missing.
+func bsonDotted(doc bson.D, path string) string {
+	parts := strings.Split(path, ".")
+	cur := doc
+	for i, part := range parts {
+		idx := BSONIndexOf(cur, part)
+		if idx < 0 {
+			return ""
+		}
+		if i == len(parts)-1 {
+			s, _ := cur[idx].Value.(string)
+			return s
+		}
+		sub, ok := cur[idx].Value.(bson.D)
+		if !ok {
+			return ""
+		}
+		cur = sub
+	}
+	return ""
+}
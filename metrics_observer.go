@@ -0,0 +1,78 @@
+package mongonet
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusObserver is a built-in ProxyObserver that exposes per-command
+// counters and duration histograms, labeled by command/db/collection/code/
+// codeName as extracted from MongoError.
+type PrometheusObserver struct {
+	commandsTotal   *prometheus.CounterVec
+	commandDuration *prometheus.HistogramVec
+}
+
+// NewPrometheusObserver builds and registers the collector's metrics
+// against reg. Pass prometheus.DefaultRegisterer to use the global
+// registry.
+func NewPrometheusObserver(reg prometheus.Registerer) *PrometheusObserver {
+	po := &PrometheusObserver{
+		commandsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mongonet",
+			Subsystem: "proxy",
+			Name:      "commands_total",
+			Help:      "Total number of commands the proxy forwarded, by outcome.",
+		}, []string{"command", "db", "collection", "code", "codeName"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "mongonet",
+			Subsystem: "proxy",
+			Name:      "command_duration_seconds",
+			Help:      "Time spent round-tripping a command through the proxy.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"command", "db", "collection"}),
+	}
+	reg.MustRegister(po.commandsTotal, po.commandDuration)
+	return po
+}
+
+type observerStateKey struct{}
+
+type observerState struct {
+	cmdName, db, collection string
+}
+
+func (po *PrometheusObserver) OnCommandStart(ctx context.Context, header MessageHeader, cmdName, ns string, requestID int32) context.Context {
+	db, coll := splitNamespace(ns)
+	return context.WithValue(ctx, observerStateKey{}, &observerState{cmdName, db, coll})
+}
+
+func (po *PrometheusObserver) OnCommandSucceeded(ctx context.Context, reply *CommandReplyMessage, durationNs int64) {
+	st := observerStateFromContext(ctx)
+	po.commandsTotal.WithLabelValues(st.cmdName, st.db, st.collection, "0", "").Inc()
+	po.commandDuration.WithLabelValues(st.cmdName, st.db, st.collection).Observe(float64(durationNs) / 1e9)
+}
+
+func (po *PrometheusObserver) OnCommandFailed(ctx context.Context, err MongoError, durationNs int64) {
+	st := observerStateFromContext(ctx)
+	po.commandsTotal.WithLabelValues(st.cmdName, st.db, st.collection, strconv.Itoa(err.GetCode()), err.GetCodeName()).Inc()
+	po.commandDuration.WithLabelValues(st.cmdName, st.db, st.collection).Observe(float64(durationNs) / 1e9)
+}
+
+func observerStateFromContext(ctx context.Context) *observerState {
+	if st, ok := ctx.Value(observerStateKey{}).(*observerState); ok {
+		return st
+	}
+	return &observerState{}
+}
+
+func splitNamespace(ns string) (db, collection string) {
+	for i := 0; i < len(ns); i++ {
+		if ns[i] == '.' {
+			return ns[:i], ns[i+1:]
+		}
+	}
+	return ns, ""
+}
@@ -10,7 +10,7 @@ type MongoError struct {
 	err      error
 	code     int
 	codeName string
-	errInfo string
+	errInfo  string
 }
 
 func NewMongoError(err error, code int, codeName string) MongoError {
@@ -48,10 +48,31 @@ func (me MongoError) GetCodeName() string {
 }
 
 func (me MongoError) Error() string {
+	errmsg := ""
+	if me.err != nil {
+		errmsg = me.err.Error()
+	}
 	return fmt.Sprintf(
 		"code=%v codeName=%v errmsg = %v",
 		me.code,
 		me.codeName,
-		me.err.Error(),
+		errmsg,
 	)
 }
+
+// ToSpanEvent renders this error as a set of OpenTelemetry span event
+// attributes, so observers can record it without reaching into MongoError's
+// unexported fields.
+func (me MongoError) ToSpanEvent() map[string]interface{} {
+	attrs := map[string]interface{}{
+		"db.response.status_code": me.code,
+		"db.mongodb.code_name":    me.codeName,
+	}
+	if me.err != nil {
+		attrs["exception.message"] = me.err.Error()
+	}
+	if me.errInfo != "" {
+		attrs["db.mongodb.error_info"] = me.errInfo
+	}
+	return attrs
+}
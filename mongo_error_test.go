@@ -0,0 +1,12 @@
+package mongonet
+
+import "testing"
+
+func TestMongoErrorErrorWithNilWrappedErr(t *testing.T) {
+	me := NewMongoError(nil, 11000, "DuplicateKey")
+	got := me.Error()
+	want := "code=11000 codeName=DuplicateKey errmsg = "
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,136 @@
+package mongonet
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// ProxyObserver is notified around every client command the proxy
+// forwards, so metrics and tracing backends can be plugged in without the
+// core intercept path knowing about either. Implementations must be safe
+// for concurrent use. An observer is attached by wrapping an interceptor
+// with NewObservingInterceptor, which takes a single ProxyObserver;
+// MultiObserver can fan a single cycle out to several.
+type ProxyObserver interface {
+	OnCommandStart(ctx context.Context, header MessageHeader, cmdName, ns string, requestID int32) context.Context
+	OnCommandSucceeded(ctx context.Context, reply *CommandReplyMessage, durationNs int64)
+	OnCommandFailed(ctx context.Context, err MongoError, durationNs int64)
+}
+
+// MultiObserver fans a single command cycle out to several ProxyObservers,
+// e.g. a Prometheus collector and an OpenTelemetry tracer at once.
+type MultiObserver []ProxyObserver
+
+func (mo MultiObserver) OnCommandStart(ctx context.Context, header MessageHeader, cmdName, ns string, requestID int32) context.Context {
+	for _, o := range mo {
+		ctx = o.OnCommandStart(ctx, header, cmdName, ns, requestID)
+	}
+	return ctx
+}
+
+func (mo MultiObserver) OnCommandSucceeded(ctx context.Context, reply *CommandReplyMessage, durationNs int64) {
+	for _, o := range mo {
+		o.OnCommandSucceeded(ctx, reply, durationNs)
+	}
+}
+
+func (mo MultiObserver) OnCommandFailed(ctx context.Context, err MongoError, durationNs int64) {
+	for _, o := range mo {
+		o.OnCommandFailed(ctx, err, durationNs)
+	}
+}
+
+// ObservingInterceptor wraps another ProxyInterceptor and reports every
+// command cycle to a ProxyObserver, so built-in metrics/tracing can be
+// layered on top of an application's own interceptor without it needing to
+// know observability exists.
+type ObservingInterceptor struct {
+	wrapped  ProxyInterceptor
+	observer ProxyObserver
+}
+
+func NewObservingInterceptor(wrapped ProxyInterceptor, observer ProxyObserver) *ObservingInterceptor {
+	return &ObservingInterceptor{wrapped, observer}
+}
+
+func (oi *ObservingInterceptor) Close() {
+	oi.wrapped.Close()
+}
+
+func (oi *ObservingInterceptor) TrackRequest(h MessageHeader) {
+	oi.wrapped.TrackRequest(h)
+}
+
+func (oi *ObservingInterceptor) TrackResponse(h MessageHeader) {
+	oi.wrapped.TrackResponse(h)
+}
+
+func (oi *ObservingInterceptor) CheckConnection() error {
+	return oi.wrapped.CheckConnection()
+}
+
+func (oi *ObservingInterceptor) CheckConnectionInterval() time.Duration {
+	return oi.wrapped.CheckConnectionInterval()
+}
+
+func (oi *ObservingInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	cmdDoc, ns, err := extractCommandDoc(m)
+	if err != nil || cmdDoc == nil {
+		return oi.wrapped.InterceptClientToMongo(m)
+	}
+	cmdName := strings.ToLower(cmdDoc[0].Key)
+
+	ctx := oi.observer.OnCommandStart(context.Background(), m.Header(), cmdName, ns, m.Header().RequestID)
+	start := time.Now()
+
+	if err := rewriteCommandDoc(m, injectTraceComment(ctx, cmdDoc)); err != nil {
+		oi.observer.OnCommandFailed(ctx, NewMongoError(err, 0, "InternalError"), time.Since(start).Nanoseconds())
+		return m, nil, err
+	}
+
+	next, ri, werr := oi.wrapped.InterceptClientToMongo(m)
+	if werr != nil {
+		if merr, ok := werr.(MongoError); ok {
+			oi.observer.OnCommandFailed(ctx, merr, time.Since(start).Nanoseconds())
+		}
+		return next, ri, werr
+	}
+
+	return next, &observingResponseInterceptor{oi.observer, ri, ctx, start}, nil
+}
+
+// observingResponseInterceptor first delegates the backend's reply to
+// whatever ResponseInterceptor the wrapped interceptor installed (if any),
+// then records OnCommandSucceeded/OnCommandFailed against what it returned.
+type observingResponseInterceptor struct {
+	observer ProxyObserver
+	wrapped  ResponseInterceptor
+	ctx      context.Context
+	start    time.Time
+}
+
+func (ori *observingResponseInterceptor) InterceptMongoToClient(m Message) (Message, error) {
+	out := m
+	var err error
+	if ori.wrapped != nil {
+		out, err = ori.wrapped.InterceptMongoToClient(m)
+	}
+
+	durationNs := time.Since(ori.start).Nanoseconds()
+	if reply, ok := out.(*CommandReplyMessage); ok {
+		if codes := replyErrorCodes(reply); len(codes) > 0 {
+			ori.observer.OnCommandFailed(ori.ctx, NewMongoError(err, codes[0], "WriteError"), durationNs)
+			return out, err
+		}
+	}
+	if err != nil {
+		ori.observer.OnCommandFailed(ori.ctx, NewMongoError(err, 0, "InternalError"), durationNs)
+		return out, err
+	}
+
+	if reply, ok := out.(*CommandReplyMessage); ok {
+		ori.observer.OnCommandSucceeded(ori.ctx, reply, durationNs)
+	}
+	return out, nil
+}
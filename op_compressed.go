@@ -0,0 +1,406 @@
+package mongonet
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Compressor IDs as defined by the OP_COMPRESSED wire protocol spec.
+const (
+	CompressorNoop   byte = 0
+	CompressorSnappy byte = 1
+	CompressorZlib   byte = 2
+	CompressorZstd   byte = 3
+)
+
+const opCompressed = 2012
+
+var compressorNames = map[string]byte{
+	"noop":   CompressorNoop,
+	"snappy": CompressorSnappy,
+	"zlib":   CompressorZlib,
+	"zstd":   CompressorZstd,
+}
+
+// CompressedMessage wraps another wire message (its OriginalOpcode and
+// uncompressed bytes), compressed with one of the negotiated compressors.
+type CompressedMessage struct {
+	header MessageHeader
+
+	OriginalOpcode    int32
+	UncompressedSize  int32
+	CompressorId      byte
+	CompressedMessage []byte
+}
+
+func (m *CompressedMessage) Header() MessageHeader {
+	return m.header
+}
+
+func (m *CompressedMessage) HasResponse() bool {
+	return false
+}
+
+func (m *CompressedMessage) Serialize() []byte {
+	size := 16 /* header */ + 9 /* originalOpcode + uncompressedSize + compressorId */ + len(m.CompressedMessage)
+	m.header.Size = int32(size)
+	m.header.OpCode = opCompressed
+
+	buf := make([]byte, size)
+	m.header.WriteInto(buf)
+
+	loc := 16
+	putInt32(buf, loc, m.OriginalOpcode)
+	loc += 4
+	putInt32(buf, loc, m.UncompressedSize)
+	loc += 4
+	buf[loc] = m.CompressorId
+	loc++
+	copy(buf[loc:], m.CompressedMessage)
+
+	return buf
+}
+
+func putInt32(buf []byte, loc int, v int32) {
+	buf[loc] = byte(v)
+	buf[loc+1] = byte(v >> 8)
+	buf[loc+2] = byte(v >> 16)
+	buf[loc+3] = byte(v >> 24)
+}
+
+func getInt32(buf []byte, loc int) int32 {
+	return int32(buf[loc]) | int32(buf[loc+1])<<8 | int32(buf[loc+2])<<16 | int32(buf[loc+3])<<24
+}
+
+// opcodeParsers lets parseCompressedMessage re-dispatch a decompressed
+// payload to the right parser without importing the rest of the wire
+// message table directly. OP_MSG and legacy OP_QUERY are registered here
+// too: real OP_COMPRESSED traffic is overwhelmingly OP_MSG (with OP_QUERY
+// only for pre-3.6 handshakes), so without them a compressed client could
+// never actually be dispatched.
+var opcodeParsers = map[int32]func(MessageHeader, []byte) (Message, error){
+	2011: parseCommandReplyMessage, // OP_COMMANDREPLY
+	2004: parseQueryMessage,        // OP_QUERY
+	2013: parseOpMsg,               // OP_MSG
+}
+
+// RegisterOpcodeParser lets other wire message implementations add
+// themselves to the OP_COMPRESSED dispatch table.
+func RegisterOpcodeParser(opcode int32, parser func(MessageHeader, []byte) (Message, error)) {
+	opcodeParsers[opcode] = parser
+}
+
+// parseCompressedMessage parses an OP_COMPRESSED envelope, decompresses
+// its payload, and re-dispatches it to the parser registered for the
+// original opcode.
+func parseCompressedMessage(header MessageHeader, buf []byte) (Message, error) {
+	if len(buf) < 9 {
+		return nil, fmt.Errorf("op_compressed: message too short: %v bytes", len(buf))
+	}
+
+	cm := &CompressedMessage{header: header}
+	cm.OriginalOpcode = getInt32(buf, 0)
+	cm.UncompressedSize = getInt32(buf, 4)
+	cm.CompressorId = buf[8]
+	cm.CompressedMessage = buf[9:]
+
+	decompressed, err := decompress(cm.CompressorId, cm.CompressedMessage, int(cm.UncompressedSize))
+	if err != nil {
+		return cm, fmt.Errorf("op_compressed: failed to decompress: %v", err)
+	}
+
+	parser, ok := opcodeParsers[cm.OriginalOpcode]
+	if !ok {
+		return cm, fmt.Errorf("op_compressed: no parser registered for original opcode %v", cm.OriginalOpcode)
+	}
+
+	innerHeader := header
+	innerHeader.OpCode = int(cm.OriginalOpcode)
+	return parser(innerHeader, decompressed)
+}
+
+// compress compresses buf with the named compressor (as negotiated during
+// the ismaster/hello handshake) and wraps it into a CompressedMessage
+// ready to serialize in place of the original message.
+func compress(header MessageHeader, originalOpcode int32, buf []byte, compressorName string) (*CompressedMessage, error) {
+	id, ok := compressorNames[compressorName]
+	if !ok {
+		return nil, fmt.Errorf("op_compressed: unknown compressor %q", compressorName)
+	}
+
+	compressed, err := compressBytes(id, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	header.OpCode = opCompressed
+	return &CompressedMessage{
+		header:            header,
+		OriginalOpcode:    originalOpcode,
+		UncompressedSize:  int32(len(buf)),
+		CompressorId:      id,
+		CompressedMessage: compressed,
+	}, nil
+}
+
+func compressBytes(id byte, buf []byte) ([]byte, error) {
+	switch id {
+	case CompressorNoop:
+		return buf, nil
+	case CompressorSnappy:
+		return snappy.Encode(nil, buf), nil
+	case CompressorZlib:
+		var out bytes.Buffer
+		w := zlib.NewWriter(&out)
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case CompressorZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(buf, nil), nil
+	default:
+		return nil, fmt.Errorf("op_compressed: unknown compressor id %v", id)
+	}
+}
+
+func decompress(id byte, buf []byte, uncompressedSize int) ([]byte, error) {
+	switch id {
+	case CompressorNoop:
+		return buf, nil
+	case CompressorSnappy:
+		return snappy.Decode(make([]byte, 0, uncompressedSize), buf)
+	case CompressorZlib:
+		r, err := zlib.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CompressorZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(buf, make([]byte, 0, uncompressedSize))
+	default:
+		return nil, fmt.Errorf("op_compressed: unknown compressor id %v", id)
+	}
+}
+
+// negotiateCompressors intersects the client's advertised "compression"
+// array (from an ismaster/hello request) with the proxy's enabled
+// compressors, preserving the client's preference order — the same rule
+// the mongo driver uses to pick a compressor for the rest of the
+// connection's lifetime.
+func negotiateCompressors(clientCompressors []string, enabledCompressors []string) []string {
+	enabled := map[string]bool{}
+	for _, c := range enabledCompressors {
+		enabled[strings.ToLower(c)] = true
+	}
+
+	var negotiated []string
+	for _, c := range clientCompressors {
+		if enabled[strings.ToLower(c)] {
+			negotiated = append(negotiated, c)
+		}
+	}
+	return negotiated
+}
+
+// CompressionConfig is the OP_COMPRESSED configuration passed to
+// NewCompressionInterceptor; ProxyConfig has no field that carries it.
+// EnabledCompressors lists the compressor names the proxy is willing to
+// negotiate with a client during the ismaster/hello handshake. Its order
+// has no effect: the client's preference order decides. A nil or empty
+// list leaves OP_COMPRESSED disabled, which is the default.
+type CompressionConfig struct {
+	EnabledCompressors []string
+}
+
+// CompressionSession tracks the compressor negotiated for a single client
+// connection and applies it to outbound messages. The zero value has no
+// compressor negotiated, so Compress is a no-op until NegotiateCompressor
+// has run.
+type CompressionSession struct {
+	compressor string
+}
+
+// NegotiateCompressor intersects clientCompressors (the "compression"
+// array off an ismaster/hello request) with cfg.EnabledCompressors,
+// records the client's first choice on cs for use by Compress, and returns
+// the negotiated list to echo back in the ismaster/hello reply's own
+// "compression" array.
+func (cfg CompressionConfig) NegotiateCompressor(cs *CompressionSession, clientCompressors []string) []string {
+	negotiated := negotiateCompressors(clientCompressors, cfg.EnabledCompressors)
+	if len(negotiated) > 0 {
+		cs.compressor = negotiated[0]
+	}
+	return negotiated
+}
+
+// Compress wraps m in an OP_COMPRESSED envelope using the compressor
+// negotiated for this connection. It returns m unchanged if no compressor
+// was negotiated (including the zero CompressionSession), so callers can
+// unconditionally pass every outbound message through it.
+func (cs *CompressionSession) Compress(m Message) (Message, error) {
+	if cs == nil || cs.compressor == "" {
+		return m, nil
+	}
+	header := m.Header()
+	body := m.Serialize()[16:]
+	return compress(header, int32(header.OpCode), body, cs.compressor)
+}
+
+// CompressionInterceptor wraps another ProxyInterceptor and makes
+// OP_COMPRESSED actually happen end to end: it watches the client's
+// ismaster/hello handshake for a "compression" array, negotiates against
+// cfg, injects the negotiated list into the handshake reply the same way
+// a real mongod does, and compresses every later outbound reply on this
+// connection with the negotiated compressor.
+type CompressionInterceptor struct {
+	wrapped ProxyInterceptor
+	cfg     CompressionConfig
+	session CompressionSession
+}
+
+// NewCompressionInterceptor wraps an existing ProxyInterceptor with
+// OP_COMPRESSED negotiation and compression, the same
+// chain-of-responsibility pattern every other interceptor in this package
+// follows. A nil or empty cfg.EnabledCompressors leaves it a no-op.
+func NewCompressionInterceptor(wrapped ProxyInterceptor, cfg CompressionConfig) *CompressionInterceptor {
+	return &CompressionInterceptor{wrapped: wrapped, cfg: cfg}
+}
+
+func (ci *CompressionInterceptor) Close() {
+	ci.wrapped.Close()
+}
+
+func (ci *CompressionInterceptor) TrackRequest(h MessageHeader) {
+	ci.wrapped.TrackRequest(h)
+}
+
+func (ci *CompressionInterceptor) TrackResponse(h MessageHeader) {
+	ci.wrapped.TrackResponse(h)
+}
+
+func (ci *CompressionInterceptor) CheckConnection() error {
+	return ci.wrapped.CheckConnection()
+}
+
+func (ci *CompressionInterceptor) CheckConnectionInterval() time.Duration {
+	return ci.wrapped.CheckConnectionInterval()
+}
+
+func (ci *CompressionInterceptor) InterceptClientToMongo(m Message) (Message, ResponseInterceptor, error) {
+	var negotiated []string
+	isHandshake := false
+
+	if len(ci.cfg.EnabledCompressors) > 0 {
+		if cmdDoc, _, err := extractCommandDoc(m); err == nil && cmdDoc != nil {
+			cmdName := strings.ToLower(cmdDoc[0].Key)
+			if cmdName == "ismaster" || cmdName == "hello" {
+				if idx := BSONIndexOf(cmdDoc, "compression"); idx >= 0 {
+					isHandshake = true
+					negotiated = ci.cfg.NegotiateCompressor(&ci.session, bsonStringArray(cmdDoc[idx].Value))
+				}
+			}
+		}
+	}
+
+	next, ri, err := ci.wrapped.InterceptClientToMongo(m)
+	if err != nil {
+		return next, ri, err
+	}
+	return next, &compressingResponseInterceptor{ci, isHandshake, negotiated, ri}, nil
+}
+
+// compressingResponseInterceptor injects the negotiated "compression"
+// array into an ismaster/hello reply, then compresses every outbound
+// message (handshake or not) with the compressor negotiated for this
+// connection, if any.
+type compressingResponseInterceptor struct {
+	ci          *CompressionInterceptor
+	isHandshake bool
+	negotiated  []string
+	wrapped     ResponseInterceptor
+}
+
+func (cri *compressingResponseInterceptor) InterceptMongoToClient(m Message) (Message, error) {
+	out := m
+	if cri.wrapped != nil {
+		var err error
+		out, err = cri.wrapped.InterceptMongoToClient(m)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	if cri.isHandshake && len(cri.negotiated) > 0 {
+		if reply, ok := out.(*CommandReplyMessage); ok {
+			doc, err := reply.CommandReply.ToBSOND()
+			if err == nil {
+				sb, err := SimpleBSONConvert(setBSONCompressionArray(doc, cri.negotiated))
+				if err == nil {
+					reply.CommandReply = sb
+					out = reply
+				}
+			}
+		}
+	}
+
+	return cri.ci.session.Compress(out)
+}
+
+// bsonStringArray converts a decoded BSON array value (primitive.A, or
+// plain []interface{} when it came off a hand-built bson.D in a test) into
+// a []string, skipping non-string elements.
+func bsonStringArray(v interface{}) []string {
+	var elems []interface{}
+	switch vv := v.(type) {
+	case primitive.A:
+		elems = vv
+	case []interface{}:
+		elems = vv
+	default:
+		return nil
+	}
+	out := make([]string, 0, len(elems))
+	for _, e := range elems {
+		if s, ok := e.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// setBSONCompressionArray returns doc with its "compression" key set to
+// names, adding the key if the reply didn't already carry one.
+func setBSONCompressionArray(doc bson.D, names []string) bson.D {
+	arr := make(primitive.A, len(names))
+	for i, n := range names {
+		arr[i] = n
+	}
+	if idx := BSONIndexOf(doc, "compression"); idx >= 0 {
+		doc[idx].Value = arr
+		return doc
+	}
+	return append(doc, bson.E{"compression", arr})
+}
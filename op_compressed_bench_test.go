@@ -0,0 +1,54 @@
+package mongonet
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// buildLargeFindReply simulates a find reply with n documents, used to
+// measure how much OP_COMPRESSED shrinks a typical large result set.
+func buildLargeFindReply(n int) []byte {
+	var out []byte
+	for i := 0; i < n; i++ {
+		doc, _ := bson.Marshal(bson.D{
+			{"_id", i},
+			{"name", "benchmark document"},
+			{"payload", "the quick brown fox jumps over the lazy dog, repeated for bulk"},
+		})
+		out = append(out, doc...)
+	}
+	return out
+}
+
+func benchmarkCompressor(b *testing.B, compressor string) {
+	buf := buildLargeFindReply(5000)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cm, err := compress(MessageHeader{}, 1, buf, compressor)
+		if err != nil {
+			b.Fatalf("compress failed: %v", err)
+		}
+		if _, err := decompress(cm.CompressorId, cm.CompressedMessage, int(cm.UncompressedSize)); err != nil {
+			b.Fatalf("decompress failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkOpCompressedSnappy(b *testing.B) {
+	benchmarkCompressor(b, "snappy")
+}
+
+func BenchmarkOpCompressedZlib(b *testing.B) {
+	benchmarkCompressor(b, "zlib")
+}
+
+func BenchmarkOpCompressedZstd(b *testing.B) {
+	benchmarkCompressor(b, "zstd")
+}
+
+func BenchmarkOpCompressedNoop(b *testing.B) {
+	benchmarkCompressor(b, "noop")
+}
@@ -0,0 +1,168 @@
+package mongonet
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCompressSetsCompressedOpcode(t *testing.T) {
+	cm, err := compress(MessageHeader{OpCode: 2013}, 2013, []byte("hello"), "snappy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cm.Header().OpCode != opCompressed {
+		t.Fatalf("expected header opcode %v, got %v", opCompressed, cm.Header().OpCode)
+	}
+	cm.Serialize()
+	if cm.header.OpCode != opCompressed {
+		t.Fatalf("expected Serialize to leave header opcode %v, got %v", opCompressed, cm.header.OpCode)
+	}
+}
+
+func TestCompressionSessionNegotiateAndCompress(t *testing.T) {
+	cfg := CompressionConfig{EnabledCompressors: []string{"zstd", "snappy"}}
+	cs := &CompressionSession{}
+
+	negotiated := cfg.NegotiateCompressor(cs, []string{"snappy", "zstd"})
+	if len(negotiated) != 2 || negotiated[0] != "snappy" || negotiated[1] != "zstd" {
+		t.Fatalf("unexpected negotiated list: %v", negotiated)
+	}
+
+	m, err := cs.Compress(&CommandReplyMessage{header: MessageHeader{OpCode: 1}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cm, ok := m.(*CompressedMessage)
+	if !ok {
+		t.Fatalf("expected a CompressedMessage, got %T", m)
+	}
+	if cm.CompressorId != CompressorSnappy {
+		t.Fatalf("expected snappy to be picked (client's first preference), got %v", cm.CompressorId)
+	}
+}
+
+func TestParseCompressedMessageDispatchesToRegisteredParser(t *testing.T) {
+	const testOpcode int32 = 987654
+	var gotHeader MessageHeader
+	var gotBuf []byte
+	RegisterOpcodeParser(testOpcode, func(h MessageHeader, buf []byte) (Message, error) {
+		gotHeader = h
+		gotBuf = append([]byte(nil), buf...)
+		return &CommandReplyMessage{header: h}, nil
+	})
+
+	payload := []byte("hello original payload")
+	cm, err := compress(MessageHeader{OpCode: int(testOpcode)}, testOpcode, payload, "zlib")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg, err := parseCompressedMessage(cm.header, cm.Serialize()[16:])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := msg.(*CommandReplyMessage); !ok {
+		t.Fatalf("expected dispatch to the registered parser, got %T", msg)
+	}
+	if gotHeader.OpCode != int(testOpcode) {
+		t.Fatalf("expected inner header opcode %v, got %v", testOpcode, gotHeader.OpCode)
+	}
+	if string(gotBuf) != string(payload) {
+		t.Fatalf("expected decompressed payload %q, got %q", payload, gotBuf)
+	}
+}
+
+func TestParseCompressedMessageUnknownOpcode(t *testing.T) {
+	const unregisteredOpcode int32 = 424242
+	cm, err := compress(MessageHeader{OpCode: int(unregisteredOpcode)}, unregisteredOpcode, []byte("x"), "noop")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := parseCompressedMessage(cm.header, cm.Serialize()[16:]); err == nil {
+		t.Fatalf("expected error for an opcode with no registered parser")
+	}
+}
+
+func TestCompressionSessionNoopWithoutNegotiation(t *testing.T) {
+	cs := &CompressionSession{}
+	orig := &CommandReplyMessage{header: MessageHeader{OpCode: 1}}
+	m, err := cs.Compress(orig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m != Message(orig) {
+		t.Fatalf("expected message to pass through unchanged when no compressor was negotiated")
+	}
+}
+
+func TestCompressionInterceptorNegotiatesAndCompressesReplies(t *testing.T) {
+	wrapped := &capturingInterceptor{}
+	ci := NewCompressionInterceptor(wrapped, CompressionConfig{EnabledCompressors: []string{"snappy"}})
+
+	helloDoc := bson.D{{"ismaster", 1}, {"compression", []interface{}{"snappy", "zstd"}}}
+	qb, err := SimpleBSONConvert(helloDoc)
+	if err != nil {
+		t.Fatalf("unexpected error building hello query: %v", err)
+	}
+	msg := &QueryMessage{Namespace: "admin.$cmd", Query: qb}
+
+	_, ri, err := ci.InterceptClientToMongo(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wrapped.calls != 1 {
+		t.Fatalf("expected the handshake to still be forwarded, got %v calls", wrapped.calls)
+	}
+
+	replyDoc, err := SimpleBSONConvert(bson.D{{"ismaster", true}, {"ok", 1}})
+	if err != nil {
+		t.Fatalf("unexpected error building hello reply: %v", err)
+	}
+	reply := &CommandReplyMessage{header: MessageHeader{OpCode: 1}, CommandReply: replyDoc}
+
+	out, err := ri.InterceptMongoToClient(reply)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cm, ok := out.(*CompressedMessage)
+	if !ok {
+		t.Fatalf("expected the negotiated handshake reply to come back compressed, got %T", out)
+	}
+	if cm.CompressorId != CompressorSnappy {
+		t.Fatalf("expected snappy to be negotiated, got compressor id %v", cm.CompressorId)
+	}
+
+	decompressed, err := decompress(cm.CompressorId, cm.CompressedMessage, int(cm.UncompressedSize))
+	if err != nil {
+		t.Fatalf("unexpected error decompressing reply: %v", err)
+	}
+	innerReply, err := parseCommandReplyMessage(MessageHeader{OpCode: 1}, decompressed)
+	if err != nil {
+		t.Fatalf("unexpected error parsing decompressed reply: %v", err)
+	}
+	replyBSON, err := innerReply.(*CommandReplyMessage).CommandReply.ToBSOND()
+	if err != nil {
+		t.Fatalf("unexpected error decoding reply BSON: %v", err)
+	}
+	idx := BSONIndexOf(replyBSON, "compression")
+	if idx < 0 {
+		t.Fatalf("expected the reply to carry a negotiated compression array, got %v", replyBSON)
+	}
+	names, ok := replyBSON[idx].Value.(primitive.A)
+	if !ok || len(names) != 1 || names[0] != "snappy" {
+		t.Fatalf("expected negotiated compression array [\"snappy\"], got %v", replyBSON[idx].Value)
+	}
+
+	// A later, non-handshake reply on the same connection should keep
+	// being compressed with the negotiated compressor.
+	anotherReply := &CommandReplyMessage{header: MessageHeader{OpCode: 1}, CommandReply: replyDoc}
+	out2, err := ri.InterceptMongoToClient(anotherReply)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out2.(*CompressedMessage); !ok {
+		t.Fatalf("expected a later reply to also be compressed, got %T", out2)
+	}
+}
@@ -0,0 +1,85 @@
+package mongonet
+
+import (
+	"context"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OTelObserver is a built-in ProxyObserver that creates one span per wire
+// message and propagates trace context to the backend via a $comment
+// field on the outbound command, since the wire protocol has no header
+// for it.
+type OTelObserver struct {
+	tracer trace.Tracer
+}
+
+func NewOTelObserver(tracer trace.Tracer) *OTelObserver {
+	return &OTelObserver{tracer}
+}
+
+type otelSpanKey struct{}
+
+func (oo *OTelObserver) OnCommandStart(ctx context.Context, header MessageHeader, cmdName, ns string, requestID int32) context.Context {
+	db, collection := splitNamespace(ns)
+	ctx, span := oo.tracer.Start(ctx, cmdName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.operation", cmdName),
+			attribute.String("db.name", db),
+			attribute.String("db.mongodb.collection", collection),
+			attribute.Int64("db.mongodb.request_id", int64(requestID)),
+		),
+	)
+	return context.WithValue(ctx, otelSpanKey{}, span)
+}
+
+func (oo *OTelObserver) OnCommandSucceeded(ctx context.Context, reply *CommandReplyMessage, durationNs int64) {
+	span := spanFromContext(ctx)
+	span.SetStatus(codes.Ok, "")
+	span.End()
+}
+
+func (oo *OTelObserver) OnCommandFailed(ctx context.Context, err MongoError, durationNs int64) {
+	span := spanFromContext(ctx)
+	for k, v := range err.ToSpanEvent() {
+		span.SetAttributes(attribute.String(k, toAttrString(v)))
+	}
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+}
+
+func spanFromContext(ctx context.Context) trace.Span {
+	if span, ok := ctx.Value(otelSpanKey{}).(trace.Span); ok {
+		return span
+	}
+	return trace.SpanFromContext(ctx)
+}
+
+func toAttrString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	if i, ok := v.(int); ok {
+		return strconv.Itoa(i)
+	}
+	return ""
+}
+
+// injectTraceComment stamps the current span context onto an outbound
+// command as a $comment field, the only place the wire protocol lets a
+// proxy thread opaque, order-preserving metadata through to mongod and
+// back out in profiler/log output.
+func injectTraceComment(ctx context.Context, cmd bson.D) bson.D {
+	span := trace.SpanFromContext(ctx)
+	sc := span.SpanContext()
+	if !sc.IsValid() {
+		return cmd
+	}
+	return append(cmd, bson.E{"$comment", sc.TraceID().String() + ":" + sc.SpanID().String()})
+}
@@ -12,16 +12,38 @@ import (
 	"time"
 
 	"github.com/go-test/deep"
+	"github.com/jr22/mongonet/failpoint"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var testFailPointRegistry = failpoint.NewRegistry()
+
 type MyFactory struct {
 }
 
 func (myf *MyFactory) NewInterceptor(ps *ProxySession) (ProxyInterceptor, error) {
-	return &MyInterceptor{ps}, nil
+	wrapped := NewFailPointInterceptor(&MyInterceptor{ps}, testFailPointRegistry)
+	// An empty EncryptionConfig leaves EncryptionInterceptor a no-op, so
+	// it's safe to chain in by default — this is the wiring point an
+	// operator would instead populate with a real EncryptedFieldsMap and
+	// KeyVault to turn CSFLE on.
+	wrapped = NewEncryptionInterceptor(wrapped, ps, EncryptionConfig{})
+	// A nil pool disables routing, so this is a no-op until a real
+	// BackendPool (built from a BackendConfig) is passed in.
+	wrapped = NewBackendRoutingInterceptor(wrapped, nil)
+	// An empty rule set matches nothing, so this is a no-op until a real
+	// CommandPolicyConfig (e.g. loaded via LoadCommandPolicyYAML) is
+	// passed in.
+	wrapped = NewCommandPolicyInterceptor(wrapped, ps, &CommandPolicy{})
+	// A nil EnabledCompressors list leaves OP_COMPRESSED negotiation a
+	// no-op, so this is safe to chain in by default — an operator turns
+	// it on by populating CompressionConfig.EnabledCompressors.
+	wrapped = NewCompressionInterceptor(wrapped, CompressionConfig{})
+	// An empty MultiObserver fans out to zero observers, so this is a
+	// no-op until a real ProxyObserver (e.g. NewOTelObserver) is added.
+	return NewObservingInterceptor(wrapped, MultiObserver{}), nil
 }
 
 type MyInterceptor struct {
@@ -127,8 +149,11 @@ func doFind(proxyPort, iteration int, shouldFail bool) error {
 	return nil
 }
 
-func enableFailPoint(mongoPort int) error {
-	client, err := getTestClient(mongoPort)
+// enableFailPoint and disableFailPoint configure an in-proxy fail point via
+// the proxyConfigureFailPoint admin command, so tests work against any
+// mongod build rather than requiring enableTestCommands=1 on the backend.
+func enableFailPoint(proxyPort int) error {
+	client, err := getTestClient(proxyPort)
 	if err != nil {
 		return err
 	}
@@ -139,7 +164,7 @@ func enableFailPoint(mongoPort int) error {
 	}
 	defer client.Disconnect(ctx)
 	cmd := bson.D{
-		{"configureFailPoint", "failCommand"},
+		{"proxyConfigureFailPoint", "failCommand"},
 		{"mode", "alwaysOn"},
 		{"data", bson.D{
 			{"failCommands", []string{"find"}},
@@ -149,8 +174,8 @@ func enableFailPoint(mongoPort int) error {
 	return client.Database("admin").RunCommand(ctx, cmd).Err()
 }
 
-func disableFailPoint(mongoPort int) error {
-	client, err := getTestClient(mongoPort)
+func disableFailPoint(proxyPort int) error {
+	client, err := getTestClient(proxyPort)
 	if err != nil {
 		return err
 	}
@@ -161,7 +186,7 @@ func disableFailPoint(mongoPort int) error {
 	}
 	defer client.Disconnect(ctx)
 	cmd := bson.D{
-		{"configureFailPoint", "failCommand"},
+		{"proxyConfigureFailPoint", "failCommand"},
 		{"mode", "off"},
 	}
 	return client.Database("admin").RunCommand(ctx, cmd).Err()
@@ -185,17 +210,12 @@ func runFinds(proxyPort int, shouldFail bool, t *testing.T) int32 {
 	return failing
 }
 
-// backing mongo must be started with --setParameter enableTestCommands=1
 func TestProxySanity(t *testing.T) {
 	mongoPort := 30000
 	proxyPort := 9900
 	if os.Getenv("MONGO_PORT") != "" {
 		mongoPort, _ = strconv.Atoi(os.Getenv("MONGO_PORT"))
 	}
-	if err := disableFailPoint(mongoPort); err != nil {
-		t.Fatalf("failed to disable failpoint. err=%v", err)
-		return
-	}
 	pc := NewProxyConfig("localhost", proxyPort, "localhost", mongoPort, "", "", "test proxy", true)
 	pc.MongoSSLSkipVerify = true
 	pc.InterceptorFactory = &MyFactory{}
@@ -235,7 +255,7 @@ func TestProxySanity(t *testing.T) {
 	}
 
 	// enable fail point - fail connections a bunch of times
-	enableFailPoint(mongoPort)
+	enableFailPoint(proxyPort)
 	failing = runFinds(proxyPort, true, t)
 
 	if atomic.LoadInt32(&failing) > 0 {
@@ -247,7 +267,7 @@ func TestProxySanity(t *testing.T) {
 		t.Fatalf("expected connections created to equal 10 but was %v", conns)
 	}
 	// disable fail point - verify connections work again
-	if err := disableFailPoint(mongoPort); err != nil {
+	if err := disableFailPoint(proxyPort); err != nil {
 		t.Fatalf("failed to disable failpoint. err=%v", err)
 		return
 	}
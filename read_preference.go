@@ -0,0 +1,183 @@
+package mongonet
+
+import (
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ReadPreference models the subset of the read preference spec the proxy
+// needs in order to select a backend: mode, tag sets, and max staleness.
+type ReadPreference struct {
+	Mode                string // "primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest"
+	TagSets             []bson.D
+	MaxStalenessSeconds int
+}
+
+var defaultReadPreference = ReadPreference{Mode: "primary"}
+
+// ParseReadPreference extracts a $readPreference document from a command,
+// falling back to "primary" when none is present (matching driver
+// behavior for commands sent outside of a session).
+func ParseReadPreference(cmd bson.D) ReadPreference {
+	idx := BSONIndexOf(cmd, "$readPreference")
+	if idx < 0 {
+		return defaultReadPreference
+	}
+	doc, ok := cmd[idx].Value.(bson.D)
+	if !ok {
+		return defaultReadPreference
+	}
+	m := doc.Map()
+
+	rp := ReadPreference{Mode: "primary"}
+	if mode, ok := m["mode"].(string); ok {
+		rp.Mode = mode
+	}
+	var tagSets []interface{}
+	switch v := m["tags"].(type) {
+	case bson.A:
+		tagSets = v
+	case []interface{}:
+		tagSets = v
+	}
+	for _, ts := range tagSets {
+		if tsDoc, ok := ts.(bson.D); ok {
+			rp.TagSets = append(rp.TagSets, tsDoc)
+		}
+	}
+	if maxStaleness, ok := m["maxStalenessSeconds"]; ok {
+		switch v := maxStaleness.(type) {
+		case int32:
+			rp.MaxStalenessSeconds = int(v)
+		case int64:
+			rp.MaxStalenessSeconds = int(v)
+		}
+	}
+	return rp
+}
+
+// SelectServer applies standard read-preference rules against the given
+// server descriptions and returns the eligible candidates, narrowed by tag
+// sets and staleness and ordered so the lowest-latency candidate is first.
+func SelectServer(servers []ServerDescription, rp ReadPreference) []ServerDescription {
+	var candidates []ServerDescription
+
+	switch rp.Mode {
+	case "primary":
+		candidates = filterByType(servers, ServerTypeRSPrimary)
+	case "secondary":
+		candidates = filterByTags(filterByType(servers, ServerTypeRSSecondary), rp.TagSets)
+	case "primaryPreferred":
+		candidates = filterByType(servers, ServerTypeRSPrimary)
+		if len(candidates) == 0 {
+			candidates = filterByTags(filterByType(servers, ServerTypeRSSecondary), rp.TagSets)
+		}
+	case "secondaryPreferred":
+		candidates = filterByTags(filterByType(servers, ServerTypeRSSecondary), rp.TagSets)
+		if len(candidates) == 0 {
+			candidates = filterByType(servers, ServerTypeRSPrimary)
+		}
+	case "nearest":
+		candidates = filterByTags(filterByType(servers, ServerTypeRSPrimary, ServerTypeRSSecondary), rp.TagSets)
+	default:
+		candidates = filterByType(servers, ServerTypeRSPrimary)
+	}
+
+	// mongos and standalone deployments have no secondaries to prefer
+	// among, so any non-replica-set server is always eligible.
+	candidates = append(candidates, filterByType(servers, ServerTypeStandalone, ServerTypeMongos)...)
+
+	candidates = filterByStaleness(candidates, rp.MaxStalenessSeconds)
+
+	return latencyWindow(candidates)
+}
+
+func filterByType(servers []ServerDescription, types ...ServerType) []ServerDescription {
+	wanted := map[ServerType]bool{}
+	for _, t := range types {
+		wanted[t] = true
+	}
+	var out []ServerDescription
+	for _, s := range servers {
+		if wanted[s.Type] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func filterByTags(servers []ServerDescription, tagSets []bson.D) []ServerDescription {
+	if len(tagSets) == 0 {
+		return servers
+	}
+	var out []ServerDescription
+	for _, s := range servers {
+		for _, tagSet := range tagSets {
+			if s.matchesTagSet(tagSet) {
+				out = append(out, s)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// filterByStaleness drops any server whose last write is further behind
+// the most recent last write among the given servers than
+// maxStalenessSeconds allows. It is a simplified approximation of the
+// spec's heartbeat-aware formula.
+func filterByStaleness(servers []ServerDescription, maxStalenessSeconds int) []ServerDescription {
+	if maxStalenessSeconds <= 0 {
+		return servers
+	}
+
+	var newestWrite time.Time
+	for _, s := range servers {
+		if s.LastWriteDate.After(newestWrite) {
+			newestWrite = s.LastWriteDate
+		}
+	}
+	if newestWrite.IsZero() {
+		return servers
+	}
+
+	maxStaleness := time.Duration(maxStalenessSeconds) * time.Second
+	var out []ServerDescription
+	for _, s := range servers {
+		if newestWrite.Sub(s.LastWriteDate) <= maxStaleness {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// latencyWindowMargin is the spec-default window (in addition to the
+// lowest observed RTT) within which servers are considered equally good.
+const latencyWindowMargin = 15 * time.Millisecond
+
+// latencyWindow orders candidates by average RTT and keeps only those
+// within latencyWindowMargin of the fastest, so callers can pick among
+// them (e.g. at random) rather than always hammering a single server.
+func latencyWindow(servers []ServerDescription) []ServerDescription {
+	if len(servers) == 0 {
+		return servers
+	}
+	fastest := servers[0].averageRTT()
+	for _, s := range servers[1:] {
+		if rtt := s.averageRTT(); rtt < fastest {
+			fastest = rtt
+		}
+	}
+	var out []ServerDescription
+	for _, s := range servers {
+		if s.averageRTT() <= fastest+latencyWindowMargin {
+			out = append(out, s)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].averageRTT() < out[j].averageRTT()
+	})
+	return out
+}
@@ -0,0 +1,130 @@
+package mongonet
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ServerType mirrors the SDAM server types a BackendPool can observe from
+// an ismaster/hello reply.
+type ServerType string
+
+const (
+	ServerTypeUnknown     ServerType = "Unknown"
+	ServerTypeStandalone  ServerType = "Standalone"
+	ServerTypeMongos      ServerType = "Mongos"
+	ServerTypeRSPrimary   ServerType = "RSPrimary"
+	ServerTypeRSSecondary ServerType = "RSSecondary"
+	ServerTypeRSArbiter   ServerType = "RSArbiter"
+	ServerTypeRSOther     ServerType = "RSOther"
+	ServerTypeRSGhost     ServerType = "RSGhost"
+)
+
+// ServerDescription is the SDAM-style view of a single backend, built from
+// the ismaster replies BackendPool's background monitor fetches over its
+// own connections. Client handshake replies passing through
+// InterceptClientToMongo are not used to update it.
+type ServerDescription struct {
+	Address        string
+	Type           ServerType
+	SetName        string
+	Tags           map[string]string
+	LastUpdateTime time.Time
+	LastWriteDate  time.Time
+
+	// rttSamples holds a bounded window of recent round-trip times in
+	// nanoseconds, used by latency-window server selection.
+	rttSamples []int64
+}
+
+const maxRTTSamples = 10
+
+// newServerDescriptionFromHello builds a ServerDescription from the BSON
+// document returned by an ismaster/hello command issued against address.
+func newServerDescriptionFromHello(address string, reply bson.D) ServerDescription {
+	m := reply.Map()
+	sd := ServerDescription{
+		Address:        address,
+		Type:           ServerTypeUnknown,
+		Tags:           map[string]string{},
+		LastUpdateTime: time.Now(),
+	}
+
+	isWritablePrimary, _ := m["ismaster"].(bool)
+	if v, ok := m["isWritablePrimary"].(bool); ok {
+		isWritablePrimary = v
+	}
+	isSecondary, _ := m["secondary"].(bool)
+	isArbiter, _ := m["arbiterOnly"].(bool)
+	msg, _ := m["msg"].(string)
+
+	setName, hasSetName := m["setName"].(string)
+	if hasSetName {
+		sd.SetName = setName
+	}
+
+	switch {
+	case msg == "isdbgrid":
+		sd.Type = ServerTypeMongos
+	case hasSetName && isWritablePrimary:
+		sd.Type = ServerTypeRSPrimary
+	case hasSetName && isSecondary:
+		sd.Type = ServerTypeRSSecondary
+	case hasSetName && isArbiter:
+		sd.Type = ServerTypeRSArbiter
+	case hasSetName:
+		sd.Type = ServerTypeRSOther
+	default:
+		sd.Type = ServerTypeStandalone
+	}
+
+	if tagsRaw, ok := m["tags"].(bson.D); ok {
+		for _, e := range tagsRaw {
+			if s, ok := e.Value.(string); ok {
+				sd.Tags[e.Key] = s
+			}
+		}
+	}
+
+	if lw, ok := m["lastWrite"].(bson.D); ok {
+		if t, ok := lw.Map()["lastWriteDate"].(time.Time); ok {
+			sd.LastWriteDate = t
+		}
+	}
+
+	return sd
+}
+
+// recordRTT appends a round trip sample to the bounded window used for
+// latency-based selection among equally eligible servers.
+func (sd *ServerDescription) recordRTT(d time.Duration) {
+	sd.rttSamples = append(sd.rttSamples, d.Nanoseconds())
+	if len(sd.rttSamples) > maxRTTSamples {
+		sd.rttSamples = sd.rttSamples[len(sd.rttSamples)-maxRTTSamples:]
+	}
+}
+
+// averageRTT returns the mean of the recorded round trip samples, or 0 if
+// none have been recorded yet.
+func (sd *ServerDescription) averageRTT() time.Duration {
+	if len(sd.rttSamples) == 0 {
+		return 0
+	}
+	var sum int64
+	for _, s := range sd.rttSamples {
+		sum += s
+	}
+	return time.Duration(sum / int64(len(sd.rttSamples)))
+}
+
+// matchesTagSet reports whether sd carries every tag in the given set.
+func (sd *ServerDescription) matchesTagSet(tagSet bson.D) bool {
+	for _, tag := range tagSet {
+		wantVal, ok := tag.Value.(string)
+		if !ok || sd.Tags[tag.Key] != wantVal {
+			return false
+		}
+	}
+	return true
+}
@@ -1,5 +1,7 @@
 package mongonet
 
+import "go.mongodb.org/mongo-driver/bson"
+
 func (m *CommandReplyMessage) HasResponse() bool {
 	return false // because its a response
 }
@@ -62,3 +64,58 @@ func parseCommandReplyMessage(header MessageHeader, buf []byte) (Message, error)
 
 	return rm, nil
 }
+
+// replyErrorCodes pulls the writeErrors[].code and writeConcernError.code
+// values out of a CommandReplyMessage's output docs, so a ProxyObserver can
+// be told about partial failures even when the command itself returned
+// ok:1 at the top level.
+func replyErrorCodes(rm *CommandReplyMessage) []int {
+	var codes []int
+	for _, doc := range rm.OutputDocs {
+		d, err := doc.ToBSOND()
+		if err != nil {
+			continue
+		}
+		m := d.Map()
+
+		var writeErrors []interface{}
+		switch v := m["writeErrors"].(type) {
+		case bson.A:
+			writeErrors = v
+		case []interface{}:
+			writeErrors = v
+		}
+		for _, we := range writeErrors {
+			if weDoc, ok := we.(bson.D); ok {
+				if code, ok := weDoc.Map()["code"]; ok {
+					if c, ok := asInt(code); ok {
+						codes = append(codes, c)
+					}
+				}
+			}
+		}
+
+		if wce, ok := m["writeConcernError"].(bson.D); ok {
+			if code, ok := wce.Map()["code"]; ok {
+				if c, ok := asInt(code); ok {
+					codes = append(codes, c)
+				}
+			}
+		}
+	}
+	return codes
+}
+
+func asInt(raw interface{}) (int, bool) {
+	switch v := raw.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}